@@ -0,0 +1,83 @@
+package conntester
+
+import (
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+// TimestampTag is the key of the tag Options.TimestampMetrics adds with the attempt's start time,
+// in microseconds since the Unix epoch. The Prometheus backend turns it into the sample timestamp
+// instead of a label; the other backends emit it like any other tag.
+const TimestampTag = "attempt_timestamp_us"
+
+// Backend is the output the probe's metrics are emitted to. Tags use the StatsD "k:v" form
+// and are translated by backends that need another form.
+type Backend interface {
+	// RecordLatency adds a latency sample to the named distribution
+	RecordLatency(name string, latency time.Duration, tags []string) error
+	// Count adds value to the named counter, e.g. 1 per attempt for the attempt count
+	Count(name string, value int64, tags []string) error
+	// Gauge sets the named gauge
+	Gauge(name string, value float64, tags []string) error
+	// RecoveryEvent reports that a target recovered from an outage, where the backend supports events
+	RecoveryEvent(title, text string, tags []string) error
+	// Flush delivers buffered metrics
+	Flush() error
+	// Close flushes and releases the backend
+	Close() error
+}
+
+// StatsdBackend sends metrics to a StatsD server or Datadog agent
+type StatsdBackend struct {
+	client *statsd.Client
+	// Sample rate in (0, 1] passed with every metric, so the client sends that fraction of them
+	// and the server scales counts back up. 1 when zero.
+	SampleRate float64
+	// Send latencies as histograms, aggregated by the agent, instead of distributions
+	Histograms bool
+}
+
+// NewStatsdBackend returns a Backend that emits to client
+func NewStatsdBackend(client *statsd.Client) *StatsdBackend {
+	return &StatsdBackend{client: client}
+}
+
+func (b *StatsdBackend) RecordLatency(name string, latency time.Duration, tags []string) error {
+	if b.Histograms {
+		return b.client.Histogram(name, latency.Seconds(), tags, b.rate())
+	}
+	return b.client.Distribution(name, latency.Seconds(), tags, b.rate())
+}
+
+func (b *StatsdBackend) Count(name string, value int64, tags []string) error {
+	return b.client.Count(name, value, tags, b.rate())
+}
+
+func (b *StatsdBackend) Gauge(name string, value float64, tags []string) error {
+	return b.client.Gauge(name, value, tags, b.rate())
+}
+
+// RecoveryEvent emits a Datadog event with the success alert type
+func (b *StatsdBackend) RecoveryEvent(title, text string, tags []string) error {
+	event := statsd.NewEvent(title, text)
+	event.AlertType = statsd.Success
+	event.Tags = tags
+	return b.client.Event(event)
+}
+
+// rate returns the sample rate to emit with
+func (b *StatsdBackend) rate() float64 {
+	if b.SampleRate == 0 {
+		return 1
+	}
+	return b.SampleRate
+}
+
+func (b *StatsdBackend) Flush() error {
+	return b.client.Flush()
+}
+
+func (b *StatsdBackend) Close() error {
+	return b.client.Close()
+}
@@ -0,0 +1,35 @@
+package conntester
+
+import (
+	"context"
+	"database/sql"
+)
+
+// BackendTracker counts the distinct database servers reached across attempts
+type BackendTracker struct {
+	seen map[string]bool
+}
+
+// NewBackendTracker returns an empty tracker for Options.Backends
+func NewBackendTracker() *BackendTracker {
+	return &BackendTracker{seen: make(map[string]bool)}
+}
+
+// observe identifies the server behind db and returns the number of distinct servers seen so far.
+// A server is keyed by its address and postmaster start time, so a restarted server counts anew.
+func (b *BackendTracker) observe(ctx context.Context, db querier) (int, error) {
+	var serverAddr sql.NullString
+	var startedAt string
+	err := db.QueryRowContext(ctx, "SELECT inet_server_addr()::text, pg_postmaster_start_time()::text").Scan(&serverAddr, &startedAt)
+	if err != nil {
+		return len(b.seen), err
+	}
+
+	// inet_server_addr() is NULL over a Unix socket
+	addr := serverAddr.String
+	if !serverAddr.Valid {
+		addr = "local"
+	}
+	b.seen[addr+"@"+startedAt] = true
+	return len(b.seen), nil
+}
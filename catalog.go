@@ -0,0 +1,234 @@
+package conntester
+
+import (
+	"database/sql"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MetricSpec describes a metric as listed by CatalogBackend
+type MetricSpec struct {
+	// Name the metric is emitted under, after any renaming
+	Name string `json:"name"`
+	// distribution, histogram, count, or gauge
+	Type string `json:"type"`
+	// Keys of the tags the metric may carry, in the order first seen
+	TagKeys []string `json:"tag_keys"`
+}
+
+// CatalogBackend records the name, type, and tag keys of every metric emitted to it instead of
+// sending it anywhere, for listing what a configuration emits. Wrapped in RenamedBackend or
+// TagFilterBackend, it lists the metrics as those would emit them. Events are not recorded.
+type CatalogBackend struct {
+	// List latencies as histograms rather than distributions, as StatsdBackend.Histograms sends them
+	Histograms bool
+
+	mu    sync.Mutex
+	specs []MetricSpec
+}
+
+// NewCatalogBackend returns an empty CatalogBackend
+func NewCatalogBackend() *CatalogBackend {
+	return &CatalogBackend{}
+}
+
+// Metrics returns the metrics recorded so far, in the order first emitted. A metric emitted
+// several times is listed once with the tag keys of all of its emissions.
+func (b *CatalogBackend) Metrics() []MetricSpec {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.specs)
+}
+
+// record adds a metric, or the tag keys it did not have yet
+func (b *CatalogBackend) record(name, metricType string, tags []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := slices.IndexFunc(b.specs, func(spec MetricSpec) bool { return spec.Name == name })
+	if i < 0 {
+		b.specs = append(b.specs, MetricSpec{Name: name, Type: metricType, TagKeys: []string{}})
+		i = len(b.specs) - 1
+	}
+	for _, tag := range tags {
+		if key := tagKey(tag); !slices.Contains(b.specs[i].TagKeys, key) {
+			b.specs[i].TagKeys = append(b.specs[i].TagKeys, key)
+		}
+	}
+}
+
+func (b *CatalogBackend) RecordLatency(name string, latency time.Duration, tags []string) error {
+	if b.Histograms {
+		b.record(name, "histogram", tags)
+	} else {
+		b.record(name, "distribution", tags)
+	}
+	return nil
+}
+
+func (b *CatalogBackend) Count(name string, value int64, tags []string) error {
+	b.record(name, "count", tags)
+	return nil
+}
+
+func (b *CatalogBackend) Gauge(name string, value float64, tags []string) error {
+	b.record(name, "gauge", tags)
+	return nil
+}
+
+func (b *CatalogBackend) RecoveryEvent(title, text string, tags []string) error {
+	return nil
+}
+
+func (b *CatalogBackend) Flush() error {
+	return nil
+}
+
+func (b *CatalogBackend) Close() error {
+	return nil
+}
+
+// DescribeMetrics emits a zero sample of every metric Run may emit with the tester's Options,
+// tagged as Run would tag it on success or failure, without connecting. Metrics that depend on
+// the server, such as the PgBouncer gauges, are emitted as if it supported them. Emitted to a
+// CatalogBackend, they list what the configuration emits.
+func (t *Tester) DescribeMetrics() {
+	client, customTags := t.Backend, t.Tags
+	opts := t.Options.withDefaults(t.Timeout)
+
+	if opts.EmitSequence {
+		client.Gauge(SequenceMetric, 0, customTags)
+	}
+	if opts.Health != nil {
+		client.Gauge(HealthScoreMetric, 0, customTags)
+	}
+	if opts.Outages != nil {
+		client.RecordLatency(OutageDurationMetric, 0, customTags)
+	}
+	if opts.TimestampMetrics {
+		customTags = append(customTags[:len(customTags):len(customTags)], TimestampTag+":0")
+	}
+	client.Count(EmitErrorsMetric, 0, customTags)
+	if opts.Persistent != nil && opts.ReconnectOnError {
+		customTags = append(customTags[:len(customTags):len(customTags)], "reconnected:false")
+	}
+
+	// Connect phase, in the order probe adds its tags
+	if opts.Driver == DefaultDriver && opts.Proxy == "" {
+		client.RecordLatency(DNSLatencyMetric, 0, statusTags(customTags, "success"))
+		if opts.StandbyURI == "" && len(opts.FailoverHosts) == 0 {
+			client.Count(AttemptCountMetric, 0, statusTags(customTags, "dns_failure", "failure_reason:dns"))
+		}
+	}
+	if opts.Persistent != nil {
+		client.Count(ReconnectMetric, 0, customTags)
+	}
+	client.Count(AttemptCountMetric, 0, statusTags(customTags, "failure", "failure_reason:unknown"))
+	if opts.StandbyURI != "" {
+		customTags = append(customTags[:len(customTags):len(customTags)], "endpoint:primary")
+	}
+	if len(opts.FailoverHosts) > 0 {
+		customTags = MergeTags(customTags, []string{"failover_index:0", "host:"})
+	}
+	if opts.TrackLocalPort {
+		client.Count(LocalPortMetric, 0, append(customTags[:len(customTags):len(customTags)], "port_bucket:0"))
+	}
+	if opts.Persistent != nil && opts.Driver == DefaultDriver {
+		customTags = append(customTags[:len(customTags):len(customTags)], "conn_reused:false")
+	}
+	if opts.RequirePrimary || (opts.DetectRole && opts.Driver == DefaultDriver) {
+		if opts.DetectRole {
+			client.RecordLatency(RoleCheckLatencyMetric, 0, statusTags(customTags, "success"))
+		}
+		customTags = append(customTags[:len(customTags):len(customTags)], "role:primary")
+	}
+	if opts.DetectVersion && opts.Driver == DefaultDriver {
+		client.RecordLatency(VersionCheckLatencyMetric, 0, statusTags(customTags, "success"))
+		customTags = append(customTags[:len(customTags):len(customTags)], "pg_version:unknown")
+	}
+	if opts.DetectSkew && opts.Driver == DefaultDriver {
+		client.Gauge(ClockSkewMetric, 0, customTags)
+	}
+	if opts.CheckCert && opts.Driver == DefaultDriver {
+		client.Gauge(CertDaysRemainingMetric, 0, customTags)
+	}
+	if opts.MinNodes > 0 {
+		customTags = append(customTags[:len(customTags):len(customTags)], "nodes:0")
+	}
+
+	tags := statusTags(customTags, "failure", "failure_reason:unknown")
+	client.RecordLatency(ConnectionLatencyMetric, 0, tags)
+	if opts.Persistent != nil {
+		client.Gauge(ColdWarmDeltaMetric, 0, customTags)
+	}
+	if opts.Driver == DefaultDriver {
+		client.RecordLatency(TCPLatencyMetric, 0, tags)
+		client.RecordLatency(TLSLatencyMetric, 0, tags)
+	}
+	if opts.Retries > 0 {
+		client.Count(RetriesMetric, 0, tags)
+	}
+	client.Count(AttemptCountMetric, 0, tags)
+
+	// Test query
+	if !opts.SkipQuery {
+		if opts.Plans != nil && len(opts.Script) == 0 {
+			customTags = append(customTags[:len(customTags):len(customTags)], "plan_hash:")
+			client.Count(PlanChangeMetric, 0, customTags)
+		}
+		queryTags := statusTags(customTags, "success")
+		txProbe := opts.TxProbe && len(opts.Script) == 0
+		if txProbe {
+			client.RecordLatency(TxLatencyMetric, 0, statusTags(customTags, "success", "tx_phase:begin"))
+			queryTags = append(queryTags, "tx_phase:begin")
+		}
+		if opts.RowCount != nil {
+			client.Gauge(RowCountMetric, 0, customTags)
+		}
+		if opts.ResultHashes != nil && len(opts.Script) == 0 && !txProbe {
+			client.Count(ResultChangeMetric, 0, append(customTags[:len(customTags):len(customTags)], "result_hash:"))
+			queryTags = append(queryTags, "result_hash:")
+		}
+		client.RecordLatency(QueryLatencyMetric, 0, queryTags)
+		if len(opts.Script) == 0 && !txProbe && opts.RowTimeout == 0 && opts.RowCount == nil && !opts.ExpectSingleRow && !opts.FailIfEmpty && opts.ResultHashes == nil {
+			client.RecordLatency(QueryTTFBMetric, 0, queryTags)
+		}
+	}
+
+	// Extra checks on a successful connection
+	if opts.PayloadSize > 0 {
+		client.RecordLatency(TransferLatencyMetric, 0, statusTags(customTags, "success"))
+		client.Gauge(TransferRateMetric, 0, statusTags(customTags, "success"))
+	}
+	if opts.MeasureLoad {
+		client.Gauge(ServerConnsMetric, 0, customTags)
+	}
+	if opts.PgBouncer {
+		for _, show := range pgBouncerCommands {
+			for _, column := range show.columns {
+				client.Gauge(PgBouncerMetricPrefix+column, 0, customTags)
+			}
+		}
+	}
+	if opts.Backends != nil {
+		client.Gauge(DistinctBackendsMetric, 0, customTags)
+	}
+	if opts.Persistent != nil {
+		for _, gauge := range poolGauges(sql.DBStats{}) {
+			client.Gauge(gauge.name, gauge.value, customTags)
+		}
+		client.Count(PoolMaxIdleTimeClosedMetric, 0, customTags)
+		client.Count(PoolMaxLifetimeClosedMetric, 0, customTags)
+	}
+	client.RecordLatency(AttemptDurationMetric, 0, statusTags(customTags, "success"))
+	if opts.Hold > 0 {
+		client.RecordLatency(HoldDurationMetric, 0, statusTags(customTags, "success"))
+	}
+}
+
+// DescribeKeepaliveMetrics emits a zero sample of every metric Keepalive may emit, without
+// connecting, as DescribeMetrics does for Run
+func (t *Tester) DescribeKeepaliveMetrics() {
+	t.Backend.Gauge(IdleSurvivedMetric, 0, t.Tags)
+	t.Backend.RecordLatency(IdleFailureAgeMetric, 0, t.Tags)
+}
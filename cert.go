@@ -0,0 +1,76 @@
+package conntester
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/chalk/conntester/internal/dsn"
+)
+
+// sslRequest is the PostgreSQL SSLRequest message: its length, 8, and the request code 80877103
+var sslRequest = []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}
+
+// serverCertificateExpiry returns when the leaf certificate the server at pgURI presents
+// expires. lib/pq gives no access to the certificates of its connections, so this makes its
+// own connection, through the same source address and proxy, and only completes the TLS
+// handshake. The certificate is not verified, since an invalid one fails the attempt's own
+// connection and its expiry is still worth reporting.
+func serverCertificateExpiry(ctx context.Context, pgURI, tlsServerName, sourceAddr, proxyURL string) (time.Time, error) {
+	components, err := dsn.ParseComponents(pgURI)
+	if err != nil {
+		return time.Time{}, err
+	}
+	host := components.Host
+	if host == "" {
+		host = "localhost"
+	}
+	if strings.HasPrefix(host, "/") {
+		return time.Time{}, errors.New("a Unix socket connection has no certificate")
+	}
+	if tlsServerName == "" {
+		tlsServerName = host
+	}
+
+	dialer := probeDialer{sourceIP: net.ParseIP(sourceAddr)}
+	if proxyURL != "" {
+		if dialer.proxyURL, err = url.Parse(proxyURL); err != nil {
+			return time.Time{}, err
+		}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, components.Port))
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(sslRequest); err != nil {
+		return time.Time{}, err
+	}
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return time.Time{}, err
+	}
+	if reply[0] != 'S' {
+		return time.Time{}, errors.New("server does not support TLS")
+	}
+
+	client := tls.Client(conn, &tls.Config{ServerName: tlsServerName, InsecureSkipVerify: true})
+	if err := client.HandshakeContext(ctx); err != nil {
+		return time.Time{}, err
+	}
+	certificates := client.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return time.Time{}, fmt.Errorf("server presented no certificate")
+	}
+	return certificates[0].NotAfter, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"strconv"
+	"time"
+)
+
+const (
+	// Factor the repeat delay grows by after each consecutive failure
+	backoffMultiplier = 2
+
+	// Upper bound on the random delay added to a backed-off attempt, as a fraction of the delay
+	backoffJitter = 0.2
+)
+
+// repeatBackoff computes the delay before the next repeat attempt, growing it after
+// consecutive failures so an unreachable database is not probed at the full rate
+type repeatBackoff struct {
+	base time.Duration
+	// Cap on the grown delay, 0 to always wait base
+	max time.Duration
+	// Random spread applied around every delay, zero for none
+	jitter  jitterValue
+	current time.Duration
+}
+
+// next returns the delay before the next attempt, given the outcome of the last one, and the
+// offset -jitter applied to it. A success resets the delay to base; a failure multiplies it,
+// up to max, and adds jitter so many probers recovering from the same outage do not retry in lockstep.
+func (b *repeatBackoff) next(success bool) (time.Duration, time.Duration) {
+	if success || b.max == 0 {
+		b.current = b.base
+		return b.spread(b.base)
+	}
+
+	if b.current < b.base {
+		b.current = b.base
+	}
+	b.current = min(b.current*backoffMultiplier, b.max)
+	jitter := time.Duration(rand.Float64() * backoffJitter * float64(b.current))
+	return b.spread(b.current + jitter)
+}
+
+// spread randomizes delay by up to the -jitter amount in either direction, so probers started
+// together, e.g. by a DaemonSet rollout, drift apart instead of hitting the database in phase.
+// It returns the randomized delay and how far it moved from delay.
+func (b *repeatBackoff) spread(delay time.Duration) (time.Duration, time.Duration) {
+	amount := b.jitter.amount
+	if b.jitter.fraction > 0 {
+		amount = time.Duration(b.jitter.fraction * float64(b.base))
+	}
+	if amount <= 0 {
+		return delay, 0
+	}
+	spread := max(0, delay+time.Duration((rand.Float64()*2-1)*float64(amount)))
+	return spread, spread - delay
+}
+
+// jitterValue is the -jitter flag: a fraction of the -repeat delay, such as 0.1, or a duration
+type jitterValue struct {
+	fraction float64
+	amount   time.Duration
+}
+
+// enabled reports whether a jitter was configured
+func (j jitterValue) enabled() bool {
+	return j.fraction > 0 || j.amount > 0
+}
+
+func (j *jitterValue) String() string {
+	if j.fraction > 0 {
+		return strconv.FormatFloat(j.fraction, 'g', -1, 64)
+	}
+	return j.amount.String()
+}
+
+func (j *jitterValue) Set(value string) error {
+	if fraction, err := strconv.ParseFloat(value, 64); err == nil {
+		if fraction < 0 || fraction > 1 {
+			return errors.New("a jitter fraction must be between 0 and 1")
+		}
+		*j = jitterValue{fraction: fraction}
+		return nil
+	}
+	amount, err := time.ParseDuration(value)
+	if err != nil {
+		return errors.New("expected a fraction such as 0.1 or a duration such as 500ms")
+	}
+	if amount < 0 {
+		return errors.New("must not be negative")
+	}
+	*j = jitterValue{amount: amount}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/chalk/conntester"
+)
+
+// circuitBreaker quiets the metrics of a prolonged outage in repeat mode. After threshold
+// consecutive failures it opens: attempts keep running, but their metrics are held back and
+// only a status:circuit_open heartbeat is emitted every interval. The first success closes it
+// and is emitted in full, so alerts clear as usual.
+type circuitBreaker struct {
+	// Consecutive failures that open the breaker, 0 to disable it
+	threshold int
+	// Time between circuit_open heartbeats while the breaker is open
+	interval time.Duration
+
+	failures      int
+	lastHeartbeat time.Time
+}
+
+// open reports whether the next attempt's metrics should be held back
+func (b *circuitBreaker) open() bool {
+	return b.threshold > 0 && b.failures >= b.threshold
+}
+
+// observe records an attempt's outcome, logging when the breaker opens or closes
+func (b *circuitBreaker) observe(success bool) {
+	if b.threshold == 0 {
+		return
+	}
+	if success {
+		if b.open() {
+			log.Printf("Circuit breaker closed after %d consecutive failures", b.failures)
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures == b.threshold {
+		log.Printf("Circuit breaker opened after %d consecutive failures, emitting a heartbeat every %v until the next success", b.failures, b.interval)
+		b.lastHeartbeat = time.Now()
+	}
+}
+
+// heartbeat emits a status:circuit_open attempt count if interval has passed since the last one
+func (b *circuitBreaker) heartbeat(client conntester.Backend, customTags []string) {
+	if time.Since(b.lastHeartbeat) < b.interval {
+		return
+	}
+	b.lastHeartbeat = time.Now()
+	tags := append(customTags[:len(customTags):len(customTags)], "status:circuit_open")
+	if err := client.Count(conntester.AttemptCountMetric, 1, tags); err != nil {
+		log.Printf("Failed to emit circuit breaker heartbeat: %v", err)
+	}
+}
+
+// heldBackend records the metrics of an attempt instead of emitting them, so they can be
+// replayed to the real backend if the attempt turns out to matter
+type heldBackend struct {
+	mu    sync.Mutex
+	calls []func(conntester.Backend) error
+}
+
+func (b *heldBackend) hold(call func(conntester.Backend) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls = append(b.calls, call)
+	return nil
+}
+
+func (b *heldBackend) RecordLatency(name string, latency time.Duration, tags []string) error {
+	return b.hold(func(client conntester.Backend) error { return client.RecordLatency(name, latency, tags) })
+}
+
+func (b *heldBackend) Count(name string, value int64, tags []string) error {
+	return b.hold(func(client conntester.Backend) error { return client.Count(name, value, tags) })
+}
+
+func (b *heldBackend) Gauge(name string, value float64, tags []string) error {
+	return b.hold(func(client conntester.Backend) error { return client.Gauge(name, value, tags) })
+}
+
+func (b *heldBackend) RecoveryEvent(title, text string, tags []string) error {
+	return b.hold(func(client conntester.Backend) error { return client.RecoveryEvent(title, text, tags) })
+}
+
+func (b *heldBackend) Flush() error {
+	return nil
+}
+
+func (b *heldBackend) Close() error {
+	return nil
+}
+
+// replay emits the held metrics to client, logging any that fail
+func (b *heldBackend) replay(client conntester.Backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, call := range b.calls {
+		if err := call(client); err != nil {
+			log.Printf("Failed to emit held metric: %v", err)
+		}
+	}
+	b.calls = nil
+}
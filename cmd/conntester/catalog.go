@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/chalk/conntester"
+)
+
+// printMetricCatalog prints the -list-metrics catalog: a line per metric with its name, type,
+// and tag keys, or a JSON array of them with -log-format json
+func printMetricCatalog(metrics []conntester.MetricSpec, jsonFormat bool) {
+	if jsonFormat {
+		data, _ := json.MarshalIndent(metrics, "", "  ")
+		fmt.Printf("%s\n", data)
+		return
+	}
+
+	width := len("NAME")
+	for _, metric := range metrics {
+		width = max(width, len(metric.Name))
+	}
+	fmt.Printf("%-*s  %-12s  %s\n", width, "NAME", "TYPE", "TAGS")
+	for _, metric := range metrics {
+		fmt.Printf("%-*s  %-12s  %s\n", width, metric.Name, metric.Type, strings.Join(metric.TagKeys, ","))
+	}
+}
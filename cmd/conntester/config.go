@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// probeConfig is the YAML file read with -config. Top-level keys other than targets are flag
+// names, e.g. "statsd: 127.0.0.1:8125", so every flag can be set from the file.
+type probeConfig struct {
+	// Flag values by flag name, applied unless the flag is also given on the command line
+	Flags map[string]string `yaml:",inline"`
+	// Databases to probe when no -uri, -uri-env, or -uri-file is given
+	Targets []targetConfig `yaml:"targets"`
+}
+
+// targetConfig is one entry of a config file's targets
+type targetConfig struct {
+	// Label the target is tagged and logged with, as with label=URI
+	Name string `yaml:"name"`
+	URI  string `yaml:"uri"`
+	// Tags added to the -tags for this target's metrics
+	Tags []string `yaml:"tags"`
+	// Test query, instead of -query
+	Query string `yaml:"query"`
+	// Connection timeout as a duration or a number of seconds, instead of -timeout
+	Timeout string `yaml:"timeout"`
+	// Delay between this target's attempts in repeat mode, as a duration or a number of
+	// seconds, instead of -repeat
+	Interval string `yaml:"interval"`
+
+	timeout  time.Duration
+	interval time.Duration
+}
+
+// loadConfig reads and validates a -config file
+func loadConfig(path string) (*probeConfig, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config probeConfig
+	if err := yaml.Unmarshal(contents, &config); err != nil {
+		return nil, err
+	}
+
+	for i := range config.Targets {
+		target := &config.Targets[i]
+		if target.URI == "" {
+			return nil, fmt.Errorf("target %d has no uri", i+1)
+		}
+		if target.Timeout != "" {
+			if err := (*secondsDuration)(&target.timeout).Set(target.Timeout); err != nil {
+				return nil, fmt.Errorf("target %d timeout: %v", i+1, err)
+			}
+		}
+		if target.Interval != "" {
+			if err := (*secondsDuration)(&target.interval).Set(target.Interval); err != nil {
+				return nil, fmt.Errorf("target %d interval: %v", i+1, err)
+			}
+			if target.interval <= 0 {
+				return nil, fmt.Errorf("target %d interval must be positive", i+1)
+			}
+		}
+	}
+	return &config, nil
+}
+
+// applyFlags sets the flags named in the file on fs, skipping those given on the command line
+func (c *probeConfig) applyFlags(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	// Apply in a fixed order so repeatable flags such as uri are deterministic
+	names := make([]string, 0, len(c.Flags))
+	for name := range c.Flags {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown flag %q", name)
+		}
+		if given[name] {
+			continue
+		}
+		if err := fs.Set(name, c.Flags[name]); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %v", c.Flags[name], name, err)
+		}
+	}
+	return nil
+}
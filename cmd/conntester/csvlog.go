@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chalk/conntester"
+	"github.com/chalk/conntester/internal/dsn"
+)
+
+// csvHeader is the first row of a -csv file
+var csvHeader = []string{"unix_timestamp", "target", "success", "connection_ms", "query_ms", "failure_reason"}
+
+// csvRecorder appends a row per attempt to the -csv file
+type csvRecorder struct {
+	// Guards the writer against concurrent -uri targets
+	mu sync.Mutex
+	w  *csv.Writer
+}
+
+// newCSVRecorder opens path for appending, writing the header if the file is new or empty
+func newCSVRecorder(path string) (*csvRecorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	recorder := &csvRecorder{w: csv.NewWriter(file)}
+	if info.Size() == 0 {
+		recorder.w.Write(csvHeader)
+		recorder.w.Flush()
+		if err := recorder.w.Error(); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to write header: %w", err)
+		}
+	}
+	return recorder, nil
+}
+
+// record appends the row of an attempt and flushes it, so a killed run still leaves complete
+// rows. The target is the target name, or the redacted URI of an unnamed target. It is a
+// no-op on a nil receiver.
+func (r *csvRecorder) record(pgURI, target string, result conntester.Result) {
+	if r == nil {
+		return
+	}
+	if target == "" {
+		target = dsn.Redact(pgURI)
+	}
+	queryMs := ""
+	if result.QueryLatency > 0 {
+		queryMs = strconv.FormatFloat(float64(result.QueryLatency.Microseconds())/1000, 'f', 3, 64)
+	}
+	row := []string{
+		strconv.FormatInt(time.Now().Unix(), 10),
+		target,
+		strconv.FormatBool(result.Success),
+		strconv.FormatFloat(float64(result.ConnectionLatency.Microseconds())/1000, 'f', 3, 64),
+		queryMs,
+		failureReason(result),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.Write(row)
+	r.w.Flush()
+	if err := r.w.Error(); err != nil {
+		log.Printf("Failed to write CSV row: %v", err)
+	}
+}
+
+// failureReason returns the failure_reason of a failed attempt, falling back to its status
+// for failures without one, such as not_primary or a failed test query. It is empty on success.
+func failureReason(result conntester.Result) string {
+	if result.Success {
+		return ""
+	}
+	if result.FailureReason != "" {
+		return result.FailureReason
+	}
+	return result.Status
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"strconv"
+	"time"
+)
+
+// secondsDuration is a duration flag that also accepts a bare number of seconds, as the
+// timeout flags took before they accepted durations
+type secondsDuration time.Duration
+
+func (d *secondsDuration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *secondsDuration) Set(value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, floatErr := strconv.ParseFloat(value, 64)
+		if floatErr != nil {
+			return errors.New("expected a duration such as 500ms or 2s, or a number of seconds")
+		}
+		parsed = time.Duration(seconds * float64(time.Second))
+	}
+	if parsed < 0 {
+		return errors.New("must not be negative")
+	}
+	*d = secondsDuration(parsed)
+	return nil
+}
+
+// secondsFlag defines a secondsDuration flag and returns a pointer to its value
+func secondsFlag(name string, value time.Duration, usage string) *time.Duration {
+	flag.Var((*secondsDuration)(&value), name, usage)
+	return &value
+}
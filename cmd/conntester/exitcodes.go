@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/chalk/conntester"
+)
+
+// Exit codes, so scripts can tell why a run failed
+const (
+	exitSuccess = 0
+	// A connection attempt failed, or more than -max-failures did, counting failed test
+	// queries with -fail-on-query-error
+	exitConnectionFailure = 1
+	// Invalid flags, configuration file, or connection URI; nothing was probed
+	exitConfigError = 2
+	// Every attempt connected, but a test query assertion such as -expect failed
+	exitQueryAssertion = 3
+	// The metrics backend could not be initialized, or -verify-metrics failed
+	exitMetricsError = 4
+	// A one-shot run connected, but exceeded -max-connection-latency or -max-query-latency
+	exitSLOBreach = 5
+)
+
+// exitCodes describes each exit code for -print-exit-codes
+var exitCodes = []struct {
+	code        int
+	description string
+}{
+	{exitSuccess, "success"},
+	{exitConnectionFailure, "connection failure, or test query failure with -fail-on-query-error"},
+	{exitConfigError, "invalid flags, configuration, or URI"},
+	{exitQueryAssertion, "test query assertion failure (-expect, -expect-single-row, -expect-rows, -min-rows, -max-rows)"},
+	{exitMetricsError, "metrics backend initialization or -verify-metrics failure"},
+	{exitSLOBreach, "latency SLO breach in a one-shot run (-max-connection-latency, -max-query-latency)"},
+}
+
+// printExitCodes prints the exit code table
+func printExitCodes() {
+	for _, exit := range exitCodes {
+		fmt.Printf("%d  %s\n", exit.code, exit.description)
+	}
+}
+
+// runOutcome tracks what a run's exit code depends on beyond the attempts' success. It is
+// safe for concurrent targets, and a nil *runOutcome records nothing.
+type runOutcome struct {
+	mu                   sync.Mutex
+	queryAssertionFailed bool
+	// First failed attempt, first failed assertion, and first SLO breach, reported by -error-json
+	failure          *failureRecord
+	assertionFailure *failureRecord
+	sloFailure       *failureRecord
+}
+
+// failureRecord is the -error-json line saying why a one-shot run failed
+type failureRecord struct {
+	Timestamp string `json:"timestamp"`
+	ExitCode  int    `json:"exit_code"`
+	// failure_reason of a failed connection, otherwise the status of the failed attempt or query
+	FailureReason string `json:"failure_reason"`
+	// Target name, or the URI with its password redacted
+	Target string `json:"target"`
+	// Error message with credentials redacted, empty if the failure had no error
+	Error string `json:"error,omitempty"`
+}
+
+// observe records an attempt's result. The attempt failed unless success, which is the
+// result's success unless -fail-on-query-error failed it, and message is its redacted error.
+func (o *runOutcome) observe(target string, result conntester.Result, success bool, message string) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	reason := result.QueryStatus
+	if !result.Success {
+		reason = failureReason(result)
+	}
+	record := &failureRecord{FailureReason: reason, Target: target, Error: message}
+	if !success && o.failure == nil {
+		o.failure = record
+	}
+	if isQueryAssertion(result.QueryStatus) {
+		o.queryAssertionFailed = true
+		if o.assertionFailure == nil {
+			o.assertionFailure = record
+		}
+	}
+	if result.SLOBreach && o.sloFailure == nil {
+		breach := *record
+		breach.FailureReason = "slo_breach"
+		o.sloFailure = &breach
+	}
+}
+
+// writeFailure writes the -error-json line for a run exiting with code to w, and nothing for a
+// successful run
+func (o *runOutcome) writeFailure(w io.Writer, code int) {
+	if o == nil || code == exitSuccess {
+		return
+	}
+	o.mu.Lock()
+	record := o.failure
+	switch code {
+	case exitQueryAssertion:
+		record = o.assertionFailure
+	case exitSLOBreach:
+		record = o.sloFailure
+	}
+	o.mu.Unlock()
+	if record == nil {
+		return
+	}
+
+	line := *record
+	line.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+	line.ExitCode = code
+	data, _ := json.Marshal(line)
+	fmt.Fprintf(w, "%s\n", data)
+}
+
+// isQueryAssertion reports whether a test query status is an assertion failure, which exits
+// exitQueryAssertion rather than failing the attempt
+func isQueryAssertion(queryStatus string) bool {
+	return queryStatus == "assertion_failure" || queryStatus == "unexpected_rows" || queryStatus == "row_count_failure"
+}
+
+// successCode returns the exit code of a run whose attempts succeeded
+func (o *runOutcome) successCode() int {
+	if o == nil {
+		return exitSuccess
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.queryAssertionFailed {
+		return exitQueryAssertion
+	}
+	return exitSuccess
+}
+
+// oneShotCode returns the exit code of a one-shot run whose attempts succeeded, which unlike a
+// repeat run's also fails on an SLO breach
+func (o *runOutcome) oneShotCode() int {
+	code := o.successCode()
+	if code != exitSuccess || o == nil {
+		return code
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.sloFailure != nil {
+		return exitSLOBreach
+	}
+	return exitSuccess
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chalk/conntester/internal/dsn"
+)
+
+// healthResult is the latest attempt against one target, as reported by /healthz
+type healthResult struct {
+	Target    string  `json:"target,omitempty"`
+	Success   bool    `json:"success"`
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Timestamp string  `json:"timestamp"`
+}
+
+// healthState holds the latest attempt result per target for the HTTP health endpoint
+type healthState struct {
+	mu sync.Mutex
+	// Latest result keyed by target URI, in the order targets first reported
+	results map[string]*healthResult
+	order   []string
+}
+
+// observe records the outcome of an attempt against pgURI, named targetName if set
+func (h *healthState) observe(pgURI, targetName string, success bool, status string, latency time.Duration) {
+	if targetName == "" {
+		// Name unnamed -dbnames targets after the database so their results can be told apart
+		if components, err := dsn.ParseComponents(pgURI); err == nil {
+			targetName = fmt.Sprintf("%s:%s/%s", components.Host, components.Port, components.DBName)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.results == nil {
+		h.results = make(map[string]*healthResult)
+	}
+	if _, ok := h.results[pgURI]; !ok {
+		h.order = append(h.order, pgURI)
+	}
+	h.results[pgURI] = &healthResult{
+		Target:    targetName,
+		Success:   success,
+		Status:    status,
+		LatencyMs: float64(latency.Microseconds()) / 1000,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// ServeHTTP answers /healthz with 200 when the latest attempt against every target succeeded,
+// and 503 when one failed or no attempt has completed yet
+func (h *healthState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	body := struct {
+		Healthy bool            `json:"healthy"`
+		Results []*healthResult `json:"results"`
+	}{Healthy: len(h.order) > 0, Results: []*healthResult{}}
+	for _, uri := range h.order {
+		result := *h.results[uri]
+		body.Healthy = body.Healthy && result.Success
+		body.Results = append(body.Results, &result)
+	}
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !body.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+// startHTTPServer serves /healthz, and /metrics when metrics is not nil, on addr in the background.
+// It returns once the listener is bound so an unusable address fails at startup.
+func startHTTPServer(addr string, health *healthState, metrics http.Handler) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", health)
+	if metrics != nil {
+		mux.Handle("/metrics", metrics)
+	}
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	paths := []string{"/healthz"}
+	if metrics != nil {
+		paths = append(paths, "/metrics")
+	}
+	log.Printf("Serving %s on %s", strings.Join(paths, " and "), listener.Addr())
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("HTTP server stopped: %v", err)
+		}
+	}()
+	return nil
+}
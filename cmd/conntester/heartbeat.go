@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/chalk/conntester"
+)
+
+// startHeartbeat counts chalk.conntester.heartbeat with the static tags now and every interval
+// until the process exits, independent of the probes, so monitors can tell a waiting
+// conntester (e.g. behind an open circuit breaker or an idling -keepalive) from a dead one
+func startHeartbeat(client conntester.Backend, interval time.Duration, customTags []string) {
+	beat := func() {
+		if err := client.Count(conntester.HeartbeatMetric, 1, customTags); err != nil {
+			log.Printf("Failed to emit heartbeat metric: %v", err)
+			return
+		}
+		if err := client.Flush(); err != nil {
+			log.Printf("Failed to flush metrics: %v", err)
+		}
+	}
+
+	beat()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			beat()
+		}
+	}()
+}
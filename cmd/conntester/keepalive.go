@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/chalk/conntester"
+	"github.com/chalk/conntester/internal/dsn"
+)
+
+// Pause before retrying a -keepalive connection that could not be opened
+const keepaliveRetryDelay = 5 * time.Second
+
+// runKeepalive repeats keepalive cycles, each opening a connection, idling it for idle, and
+// querying it, until interrupted. It flushes the metrics after every cycle and before exiting.
+func runKeepalive(pgURI string, timeout time.Duration, client conntester.Backend, customTags []string, opts probeOptions, idle, flushTimeout time.Duration) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tester := conntester.Tester{
+		URI:     pgURI,
+		Timeout: timeout,
+		Backend: client,
+		Tags:    customTags,
+		Options: opts.Options,
+	}
+	for ctx.Err() == nil {
+		tester.AttemptID = newAttemptID()
+		result, err := tester.Keepalive(ctx, idle)
+		switch {
+		case ctx.Err() != nil:
+		case result.Survived:
+			fmt.Printf("[attempt %s] Idle connection survived %v (query: %.3fms)\n",
+				tester.AttemptID, idle, float64(result.QueryLatency.Microseconds())/1000)
+		case result.Age > 0:
+			fmt.Printf("[attempt %s] Idle connection failed after %v\n", tester.AttemptID, result.Age.Round(time.Millisecond))
+		default:
+			log.Printf("[attempt %s] Failed to open keepalive connection, retrying in %v: %s",
+				tester.AttemptID, keepaliveRetryDelay, dsn.RedactError(err, pgURI))
+			sleepUntilDone(ctx, keepaliveRetryDelay)
+		}
+
+		if err := client.Flush(); err != nil {
+			log.Printf("Failed to flush metrics: %v", err)
+		}
+	}
+
+	flushWithTimeout(client, flushTimeout)
+	fmt.Println("Stopping keepalive checks")
+}
+
+// sleepUntilDone waits for d or until ctx is done, whichever comes first
+func sleepUntilDone(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/chalk/conntester"
+)
+
+// runLoadTest runs concurrency workers that each probe back to back until duration elapses,
+// emitting every attempt's metrics, then prints the latency summary and the throughput.
+// It returns false if any attempt failed.
+func runLoadTest(pgURI string, timeout time.Duration, client conntester.Backend, customTags []string, opts probeOptions, concurrency int, duration time.Duration) bool {
+	opts = opts.withoutIterationState()
+
+	summary := &latencySummary{}
+	start := time.Now()
+	deadline := start.Add(duration)
+
+	done := make(chan struct{})
+	for worker := 0; worker < concurrency; worker++ {
+		// Each worker gets its own capacity-limited tags so no two attempts append into one array
+		tester := conntester.Tester{
+			URI:     pgURI,
+			Timeout: timeout,
+			Backend: client,
+			Tags:    customTags[:len(customTags):len(customTags)],
+			Options: opts.Options,
+		}
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for time.Now().Before(deadline) {
+				result, _ := tester.Run(context.Background())
+				summary.record(result.Success, result.SLOBreach, result.ConnectionLatency, result.QueryLatency)
+			}
+		}()
+	}
+	for range concurrency {
+		<-done
+	}
+	elapsed := time.Since(start)
+
+	summary.print()
+	opts.summaryFile.write(summary)
+	fmt.Printf("Throughput: %.1f attempts/sec over %v with %d workers\n",
+		float64(summary.attempts)/elapsed.Seconds(), elapsed.Round(time.Millisecond), concurrency)
+	return summary.successes == summary.attempts
+}
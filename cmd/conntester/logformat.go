@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chalk/conntester/internal/dsn"
+)
+
+// attemptRecord is the JSON object written to stdout for each attempt with -log-format json
+type attemptRecord struct {
+	Timestamp    string   `json:"timestamp"`
+	AttemptID    string   `json:"attempt_id"`
+	Target       string   `json:"target,omitempty"`
+	URI          string   `json:"uri"`
+	Success      bool     `json:"success"`
+	Status       string   `json:"status"`
+	ConnectionMs float64  `json:"connection_ms"`
+	QueryMs      *float64 `json:"query_ms,omitempty"`
+	Error        string   `json:"error,omitempty"`
+	Tags         []string `json:"tags"`
+}
+
+// newAttemptRecord builds the record of an attempt. The URI is redacted, and the query latency
+// is omitted when the test query did not run.
+func newAttemptRecord(attemptID, pgURI, target string, success bool, status string, latency, queryLatency time.Duration, message string, tags []string) attemptRecord {
+	record := attemptRecord{
+		Timestamp:    time.Now().UTC().Format(time.RFC3339Nano),
+		AttemptID:    attemptID,
+		Target:       target,
+		URI:          dsn.Redact(pgURI),
+		Success:      success,
+		Status:       status,
+		ConnectionMs: float64(latency.Microseconds()) / 1000,
+		Error:        message,
+		Tags:         tags,
+	}
+	if queryLatency > 0 {
+		queryMs := float64(queryLatency.Microseconds()) / 1000
+		record.QueryMs = &queryMs
+	}
+	if record.Tags == nil {
+		record.Tags = []string{}
+	}
+	return record
+}
+
+// newAttemptID returns a short random ID for an attempt. It is only logged, not tagged, since
+// a tag with a new value per attempt would create a metric context per attempt.
+func newAttemptID() string {
+	var id [4]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// jsonLogWriter is the log package's output with -log-format json. It wraps each logged line,
+// such as a connection error, in a JSON object with a timestamp.
+type jsonLogWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	line, err := json.Marshal(struct {
+		Timestamp string `json:"timestamp"`
+		Message   string `json:"message"`
+	}{time.Now().UTC().Format(time.RFC3339Nano), strings.TrimSuffix(string(p), "\n")})
+	if err != nil {
+		return 0, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.out.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -3,263 +3,2113 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
-	_ "github.com/lib/pq"
+	"github.com/chalk/conntester"
+	"github.com/chalk/conntester/internal/dsn"
+	"github.com/go-sql-driver/mysql"
+	"github.com/robfig/cron/v3"
 )
 
 const (
-	// Metric names
-	attemptCountMetric      = "chalk.conntester.attempt_count"
-	connectionLatencyMetric = "chalk.conntester.duration"
-	queryLatencyMetric      = "chalk.conntester.test_query_duration"
+	// Default connection timeout
+	defaultTimeout = 5 * time.Second
 
-	// Default timeout in seconds
-	defaultTimeout = 5
+	// Default upper bound on the synchronous metric flush before exiting, and the preflight write timeout
+	exitFlushTimeout = 2 * time.Second
+
+	// Pause between the two -verify-metrics sentinel writes, long enough for a UDP refusal to arrive
+	preflightPause = 100 * time.Millisecond
+
+	// Environment variable holding default k:v,k:v tags with the lowest precedence
+	defaultTagsEnv = "CONNTESTER_DEFAULT_TAGS"
 )
 
-func main() {
-	// Parse command line arguments
-	pgURI := flag.String("uri", "", "PostgreSQL connection URI (required)")
-	timeout := flag.Int("timeout", defaultTimeout, "Connection timeout in seconds")
-	statsdAddr := flag.String("statsd", "127.0.0.1:8125", "StatsD server address")
-	repeat := flag.Float64("repeat", 0, "Repeat delay in seconds (0 = no repeat, default 1 second if used without value)")
-	tags := flag.String("tags", "", "Custom tags in format k:v,k:v to add to metrics")
-	flag.Parse()
+func main() {
+	// Dispatch subcommands before parsing the probe flags
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(runDoctor(os.Args[2:]))
+	}
+
+	// Parse command line arguments
+	var uris uriList
+	flag.Var(&uris, "uri", "PostgreSQL connection URI, or a DSN for the selected -driver (required unless -uri-env or -uri-file is set). Repeat to probe several databases concurrently, each optionally as label=URI")
+	vars := uriVars{}
+	flag.Var(vars, "var", "Value for a {{key}} placeholder in the URIs, as key=value (e.g. -var host=db1 -var db=app with -uri postgres://app@{{host}}/{{db}}); repeat for each key")
+	uriEnv := flag.String("uri-env", "", "Name of an environment variable holding the connection URI, instead of -uri")
+	uriFile := flag.String("uri-file", "", "Path of a file holding the connection URI, instead of -uri")
+	configFile := flag.String("config", "", "YAML file of flag values and targets, each with its own uri, tags, query, and timeout; command-line flags take precedence")
+	driver := flag.String("driver", conntester.DefaultDriver, "database/sql driver to connect with (postgres or mysql; use postgres for CockroachDB)")
+	timeout := secondsFlag("timeout", defaultTimeout, "Connection timeout as a duration (e.g. 500ms, 2s) or a number of seconds")
+	retries := flag.Int("retries", 0, "Retry a failed connection up to N times within the attempt, and its -timeout, before counting it as failed")
+	retryDelay := flag.Duration("retry-delay", 500*time.Millisecond, "Wait between -retries")
+	output := flag.String("output", "statsd", "Metrics backend: statsd, prometheus to write -prom-textfile and/or push to -prom-pushgateway, or otlp to export to -otlp-endpoint")
+	promTextfile := flag.String("prom-textfile", "", "With -output prometheus, .prom file rewritten after every attempt for the node_exporter textfile collector")
+	promPushgateway := flag.String("prom-pushgateway", "", "With -output prometheus, Pushgateway URL the metrics are pushed to after every attempt")
+	promJob := flag.String("prom-job", "conntester", "Pushgateway job name")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "With -output otlp, OTLP/HTTP collector URL (e.g. http://localhost:4318)")
+	httpAddr := flag.String("http-addr", "", "Serve /healthz, reflecting the latest attempt, and /metrics with -output prometheus on this address (e.g. :8080)")
+	namespace := flag.String("namespace", "", "Namespace prepended to every metric name, e.g. myteam (a trailing dot is added)")
+	metricPrefix := flag.String("metric-prefix", conntester.MetricStem, "Stem metric names are built from, replacing chalk.conntester in e.g. chalk.conntester.duration")
+	metricType := flag.String("metric-type", "distribution", "StatsD type latencies are sent as: distribution or histogram")
+	sampleRate := flag.Float64("sample-rate", 1, "StatsD sample rate in (0, 1] for every metric, to send fewer packets at high -repeat frequencies")
+	statsdAddrs := &addrList{addrs: []string{"127.0.0.1:8125"}}
+	flag.Var(statsdAddrs, "statsd", "StatsD server address, as host:port for UDP or unix:///path/to/socket for a Unix domain socket. Repeat, or separate addresses with commas, to send every metric to each")
+	repeat := flag.Float64("repeat", 0, "Repeat delay in seconds (0 = no repeat, default 1 second if used without value)")
+	strictTags := flag.Bool("strict-tags", false, "Exit with an error instead of warning when -tags, -tags-env, or "+defaultTagsEnv+" has malformed tags")
+	jsonSummary := flag.String("json-summary", "", "Write the final summary of a -count, -repeat, or -concurrency run to this file as JSON")
+	csvPath := flag.String("csv", "", "Append one row per attempt to this CSV file for offline analysis")
+	errorTemplate := flag.String("error-template", "", "Go template for the line printed on a failed attempt, over the attempt's result: .Status, .QueryStatus, .FailureReason, .ConnectionLatency, .QueryLatency, .Tags, and .Target, .AttemptID, and .Error (default: the built-in message)")
+	logFormat := flag.String("log-format", "text", "Output format: text, or json for one JSON object per attempt on stdout and JSON log lines on stderr")
+	tags := flag.String("tags", "", "Custom tags in format k:v,k:v to add to metrics")
+	tagsEnv := flag.String("tags-env", "", "Environment variable with more tags, comma- or space-separated as in DD_TAGS, merged under -tags")
+	bindTarget := flag.Bool("bind-metrics-to-target", false, "Tag metrics host:, port:, and db: from each target's connection string, under any of the same keys in -tags")
+	autoHostTag := flag.Bool("auto-host-tag", false, "Add a host:<hostname> tag, unless another tag source sets host")
+	dropTags := tagDrops{}
+	flag.Var(dropTags, "drop-tags", "Tag keys to leave off specific metrics, as metric=key,key (e.g. attempt_count=pg_version,role); separate metrics with semicolons or repeat the flag")
+	var jitter jitterValue
+	flag.Var(&jitter, "jitter", "Randomize each -repeat delay by up to this much in either direction, as a fraction of the delay (e.g. 0.1) or a duration (e.g. 500ms)")
+	var window windowSize
+	flag.Var(&window, "window", "In repeat mode, emit min, avg, max, and p95 gauges of the connection latency over this many recent attempts (e.g. 100) or this long (e.g. 5m) after every attempt (default: disabled)")
+	breakerThreshold := flag.Int("breaker-threshold", 0, "In repeat mode, after N consecutive failures hold back each failed attempt's metrics and emit a status:circuit_open heartbeat instead, until a success (0 = disabled)")
+	breakerInterval := flag.Duration("breaker-interval", time.Minute, "Time between status:circuit_open heartbeats while -breaker-threshold has tripped")
+	maxBackoff := flag.Duration("max-backoff", 0, "In repeat mode, double the delay after each consecutive failure, plus jitter, up to this cap (0 = fixed delay)")
+	cronSpec := flag.String("cron", "", "Run attempts on a standard 5-field cron schedule (e.g. \"*/5 9-17 * * 1-5\") instead of -repeat")
+	verifyMetrics := flag.Bool("verify-metrics", false, "At startup, write a uniquely tagged sentinel metric to the StatsD socket and exit if it cannot be delivered")
+	heartbeatInterval := flag.Duration("heartbeat-interval", 0, "Count chalk.conntester.heartbeat with only the static tags this often, independent of the probes, to alert on conntester itself being down (0 = disabled)")
+	statsdBuffer := flag.Int("statsd-buffer", 0, "Maximum metrics per StatsD payload (0 = as many as fit in a datagram)")
+	statsdFlushInterval := flag.Duration("statsd-flush-interval", 0, "Send buffered StatsD metrics on this interval instead of after every attempt (0 = after every attempt)")
+	flushTimeout := flag.Duration("flush-timeout", exitFlushTimeout, "How long to wait for buffered metrics to be delivered before exiting")
+	verbose := flag.Bool("v", false, "Verbose output: print the resolved configuration at startup and a timing breakdown of each attempt")
+	quiet := flag.Bool("quiet", false, "Quiet output: print only failed attempts and the final summary, not each successful attempt")
+	dryRun := flag.Bool("dry-run", false, "Run the attempts but print every metric to stdout in the StatsD format instead of sending it to -output")
+	noFlushOnExit := flag.Bool("no-flush-on-exit", false, "Skip the synchronous StatsD flush before exiting with a failure")
+	count := flag.Int("count", 0, "Stop after N attempts, every -repeat seconds or back to back without -repeat, and exit non-zero if more than -max-failures failed (0 = unlimited)")
+	maxRuntime := flag.Duration("max-runtime", 0, "In repeat mode, stop after this long, print the summary, and exit non-zero if more than -max-failures attempts failed (0 = unlimited)")
+	maxFailures := flag.Int("max-failures", 0, "Number of failed attempts a -count or -max-runtime run tolerates before exiting non-zero")
+	matrix := flag.Bool("matrix", false, "Probe every target exactly once, print a pass/fail table of the targets, and exit non-zero if any failed, e.g. as a go/no-go gate after a migration")
+	untilFailure := flag.Bool("until-failure", false, "Run attempts back to back (or every -repeat seconds) and exit non-zero with a detailed report on the first failure")
+	rampDown := flag.Int("ramp-down", 0, "Probe with concurrency stepping down from N to 1 and report latency per level, then exit (0 = disabled)")
+	rampStep := flag.Duration("ramp-step-duration", 10*time.Second, "How long each -ramp-down concurrency level runs")
+	warmup := flag.Int("warmup", 0, "Run N attempts first whose results are printed but kept out of the metrics, summary, and health state")
+	concurrency := flag.Int("concurrency", 0, "Load test with N workers probing back to back for -duration, then print the latency summary and throughput (0 = disabled)")
+	loadDuration := flag.Duration("duration", 30*time.Second, "How long a -concurrency load test runs")
+	query := flag.String("query", conntester.DefaultQuery, "Test query run after connecting; only the first column of the first row is read")
+	queryFile := flag.String("query-file", "", "SQL script run as the test query instead of -query, split into statements on semicolons and executed in order on one connection")
+	queryTimeout := secondsFlag("query-timeout", 0, "Test query timeout as a duration or a number of seconds (0 = same as -timeout)")
+	errorJSON := flag.Bool("error-json", false, "When a one-shot run fails, write one JSON line to stderr with the failure reason, the redacted target, and the exit code")
+	failOnQueryError := flag.Bool("fail-on-query-error", false, "Fail the attempt, and exit 1, when the test query fails, instead of only when the connection fails")
+	readOnly := flag.Bool("read-only", false, "Run the test query in a read-only transaction that is rolled back afterward, so a custom -query or -query-file cannot write; a write fails with status:query_failure")
+	txProbe := flag.Bool("tx-probe", false, "Run the test query inside a transaction (BEGIN, query, COMMIT), timing each phase as chalk.conntester.tx_duration; a failed phase is rolled back and tagged status:tx_failure")
+	rollback := flag.Bool("rollback", false, "Run the test query between BEGIN and ROLLBACK so a write such as an INSERT is probed without leaving data; the query is timed from BEGIN to ROLLBACK and succeeds only if the rollback does")
+	noQuery := flag.Bool("no-query", false, "Only connect and ping; never run the test query, for proxies that allow nothing past authentication")
+	queryInterval := flag.Int("query-interval", 1, "In repeat or cron mode, run the test query only every Nth iteration (every iteration still pings)")
+	rowTimeout := flag.Duration("row-timeout", 0, "Read all rows of the test query, failing with status:stream_stall if any row takes longer than this (0 = single-row scan)")
+	expectRows := flag.Int("expect-rows", -1, "Fail the test query with status:row_count_failure unless it returns exactly N rows, and emit the count as chalk.conntester.row_count (-1 = disabled)")
+	minRows := flag.Int("min-rows", -1, "Fail the test query with status:row_count_failure if it returns fewer than N rows (-1 = no minimum)")
+	maxRows := flag.Int("max-rows", -1, "Fail the test query with status:row_count_failure if it returns more than N rows; counting stops at N+1 (-1 = no maximum)")
+	maxConnectionLatency := flag.Duration("max-connection-latency", 0, "Latency SLO: tag a successful connection slower than this status:slo_breach and, in a one-shot run, exit 5 (0 = disabled)")
+	maxQueryLatency := flag.Duration("max-query-latency", 0, "Latency SLO: give a successful test query slower than this status:slo_breach and, in a one-shot run, exit 5 (0 = disabled)")
+	failIfEmpty := flag.Bool("fail-if-empty", false, "Fail the attempt with status:empty_result when the test query returns no rows")
+	expectSingleRow := flag.Bool("expect-single-row", false, "Read every row of the test query and fail with status:unexpected_rows if more than one is returned")
+	expect := flag.String("expect", "", "Fail the test query with status:assertion_failure unless its first column, as a string, equals this value (e.g. false for SELECT pg_is_in_recovery()), or satisfies the comparison it starts with: >, <, >=, <=, !=, or ~ for a regular expression (e.g. \"<100\" or \"~^ok\")")
+	maxResultBytes := flag.Int("max-result-bytes", 0, "Stop reading the test query result and give it status:result_too_large once its column data exceeds this many bytes, with -row-timeout, -expect-single-row, -expect-rows, -min-rows, -max-rows, -fail-if-empty, or -hash-result (0 = no limit)")
+	hashResult := flag.Bool("hash-result", false, "Read the whole test query result, tag its metrics result_hash:<hash>, and count chalk.conntester.result_change when the hash differs from the previous attempt's")
+	explain := flag.Bool("explain", false, "Run EXPLAIN (FORMAT JSON) on the test query before each attempt's query, tag its metrics plan_hash:<hash>, and count chalk.conntester.plan_change when the plan differs from the baseline")
+	explainBaseline := flag.String("explain-baseline", "", "Plan hash -explain compares against, e.g. one logged by an earlier run (default: the first attempt's plan)")
+	sourceAddr := flag.String("source-addr", "", "Local IP address to connect from, e.g. to choose the interface on a multi-homed host")
+	trackLocalPort := flag.Bool("track-local-port", false, "Log the local address of each connection and count connections by local port bucket")
+	sslMode := flag.String("sslmode", "", "sslmode set on the connection URIs, overriding any in them (e.g. verify-full)")
+	sslRootCert := flag.String("sslrootcert", "", "CA bundle file set as sslrootcert on the connection URIs, overriding any in them")
+	sslCert := flag.String("sslcert", "", "Client certificate file set as sslcert on the connection URIs, overriding any in them")
+	sslKey := flag.String("sslkey", "", "Client key file set as sslkey on the connection URIs, overriding any in them")
+	tlsServerName := flag.String("tls-servername", "", "Verify the server certificate and send SNI for this name instead of the host in -uri")
+	proxyURL := flag.String("proxy", "", "SOCKS5 proxy URL to connect through, e.g. socks5://bastion:1080")
+	failover := flag.String("failover", "", "Comma-separated host:port list tried in order within the same attempt if the URI's host fails")
+	standby := flag.String("standby", "", "Standby connection URI tried within the same attempt if the primary fails")
+	requirePrimary := flag.Bool("require-primary", false, "Fail with status:not_primary if the server is a replica (pg_is_in_recovery)")
+	detectRole := flag.Bool("detect-role", false, "Tag metrics role:primary or role:replica from pg_is_in_recovery(), timing the check as chalk.conntester.role_check_duration")
+	checkCert := flag.Bool("check-cert", false, "Emit the days until the server's TLS certificate expires as chalk.conntester.cert_days_remaining, from a separate TLS handshake")
+	certWarnDays := flag.Int("cert-warn-days", 0, "With -check-cert, fail attempts with status:cert_expiring when the certificate expires in fewer than N days (0 = disabled)")
+	detectSkew := flag.Bool("detect-skew", false, "Emit the server's clock offset from the local clock as chalk.conntester.clock_skew_seconds, from SELECT now()")
+	detectVersion := flag.Bool("detect-version", false, "Tag metrics pg_version:<major> from SHOW server_version, timing the check as chalk.conntester.version_check_duration")
+	successSQLStates := flag.String("success-sqlstate", "", "Comma-separated SQLSTATE codes (e.g. 28P01,42501) whose errors count as status:success, for negative health checks")
+	minNodes := flag.Int("min-nodes", 0, "Fail with status:insufficient_nodes when fewer nodes (primary plus streaming replicas) are healthy (0 = disabled)")
+	payloadSize := flag.Int("payload-size", 0, "Fetch a result of this many bytes after the test query to measure transfer time (0 = disabled)")
+	outlierThreshold := flag.Duration("outlier-threshold", 0, "Tag the attempt duration metric with status:outlier when an attempt takes longer than this (0 = disabled)")
+	hold := flag.Duration("hold", 0, "After a successful connect and query, keep the connection open this long while pinging it (0 = disabled)")
+	holdInterval := flag.Duration("hold-interval", time.Second, "Interval between pings while holding the connection open")
+	keepalive := flag.Duration("keepalive", 0, "Repeatedly open a connection, leave it idle this long, then query it, emitting chalk.conntester.idle_survived to catch middleboxes that drop idle connections (0 = disabled)")
+	credentialFile := flag.String("credential-file", "", "File holding the password, used instead of the URI's and re-read when the -persistent connection fails to authenticate, for rotated credentials")
+	prewarm := flag.Int("prewarm", 0, "With -persistent, open this many connections at once with concurrent pings before the first attempt, logging how long it took, so the first attempt starts warm (0 = disabled)")
+	reconnectOnError := flag.Bool("reconnect-on-error", false, "With -persistent, close the connection after a failed attempt or test query so the next attempt reconnects, tagging every attempt reconnected:true or reconnected:false")
+	persistent := flag.Bool("persistent", false, "Keep one connection open across attempts and only ping and query it each attempt, reconnecting when it is found dead")
+	emitSequence := flag.Bool("emit-sequence", false, "Emit a monotonically increasing attempt sequence number so gaps reveal dropped metrics")
+	timestampMetrics := flag.Bool("timestamp-metrics", false, "Stamp each attempt's metrics with its start time in microseconds, so the backend does not aggregate distinct attempts together. -output prometheus or otlp only")
+	emitZero := flag.Bool("emit-zero-on-startup", false, "Emit zero-valued metrics tagged status:startup before the first attempt so dashboards have data immediately")
+	pgBouncer := flag.Bool("pgbouncer", false, "After connecting, emit the target database's pool and stats gauges from the PgBouncer admin console as chalk.conntester.pgbouncer.*")
+	measureServerLoad := flag.Bool("measure-server-load", false, "After connecting, emit the server's open connection count from pg_stat_activity")
+	trackBackends := flag.Bool("track-backends", false, "Count distinct database servers (address and start time) reached across attempts")
+	recoveryEvents := flag.Bool("recovery-events", false, "Emit a recovery event with the outage duration when a target recovers after failures")
+	healthScore := flag.Bool("health-score", false, "Emit a 0-100 health score combining recent success rate and latency headroom")
+	healthWindow := flag.Int("health-window", 10, "Number of recent attempts considered by the health score")
+	healthLatency := flag.Duration("health-latency-threshold", time.Second, "Connection latency at which the health score's latency component reaches zero")
+	healthSuccessWeight := flag.Float64("health-success-weight", 0.7, "Weight of the success rate in the health score")
+	healthLatencyWeight := flag.Float64("health-latency-weight", 0.3, "Weight of the latency headroom in the health score")
+	appName := flag.String("app-name", "conntester", "application_name set on PostgreSQL connections whose URI does not set one, to find them in pg_stat_activity and the server logs (empty to leave unset)")
+	clientID := flag.String("client-id", "", "Client identifier reported to the server (application_name for PostgreSQL, the program_name connection attribute for MySQL)")
+	webhookURL := flag.String("webhook-url", "", "POST a JSON notification to this URL when the target goes down or recovers")
+	webhookTemplate := flag.String("webhook-template", "", "Go template for the webhook body over .Target, .Reason, .LatencyMs, and .Timestamp (default: JSON)")
+	webhookDebounce := flag.Duration("webhook-debounce", time.Minute, "Minimum time between webhook notifications")
+	batchMode := flag.String("batch-mode", "", "How the targets of each attempt are probed: sequential, parallel, or bounded to -batch-concurrency at once (default: parallel for several -uri values or -config targets, sequential for -dbnames)")
+	batchConcurrency := flag.Int("batch-concurrency", 0, "With -batch-mode bounded, maximum number of targets probed at once")
+	randomize := flag.Bool("randomize", false, "Shuffle the order the targets are probed in on every attempt, so the same targets are not always probed first")
+	seed := flag.Uint64("seed", 0, "With -randomize, seed for the shuffle so a run's target order can be reproduced (0 = random, printed at startup)")
+	dbNames := flag.String("dbnames", "", "Comma-separated databases on the -uri server to probe in turn each attempt, tagged dbname:<name>")
+	showExitCodes := flag.Bool("print-exit-codes", false, "Print the exit codes and their meanings, then exit")
+	listMetrics := flag.Bool("list-metrics", false, "Print every metric this configuration would emit, with its type and tag keys, then exit without connecting")
+	nameTemplate := flag.String("name-template", "", "Go template over the parsed URI (e.g. {{.Host}}/{{.DBName}}) used to name the target in tags and logs")
+	flag.Parse()
+	if *showExitCodes {
+		printExitCodes()
+		os.Exit(exitSuccess)
+	}
+
+	// Fill in the flags not given on the command line from the config file
+	var config *probeConfig
+	if *configFile != "" {
+		var err error
+		config, err = loadConfig(*configFile)
+		if err == nil {
+			err = config.applyFlags(flag.CommandLine)
+		}
+		if err != nil {
+			fmt.Printf("Error: -config %s: %v\n", *configFile, err)
+			os.Exit(exitConfigError)
+		}
+	}
+
+	// Validate required parameters
+	uriSources := 0
+	for _, set := range []bool{len(uris) > 0, *uriEnv != "", *uriFile != ""} {
+		if set {
+			uriSources++
+		}
+	}
+	// The config file's targets are probed only when no URI was given otherwise
+	configTargets := uriSources == 0 && config != nil && len(config.Targets) > 0
+	// Otherwise, with the postgres driver, PGHOST and the other PG* variables can describe the target on their own
+	envTarget := uriSources == 0 && !configTargets && *driver == conntester.DefaultDriver && os.Getenv("PGHOST") != ""
+	if envTarget {
+		uris = uriList{""}
+	}
+	if uriSources > 1 || (uriSources == 0 && !configTargets && !envTarget) {
+		fmt.Println("Error: exactly one of -uri, -uri-env, or -uri-file is required, unless -config has targets or PGHOST is set")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// Read the URI from the environment or a file so the password stays out of ps and shell history
+	if *uriEnv != "" {
+		uris = uriList{os.Getenv(*uriEnv)}
+		if uris[0] == "" {
+			fmt.Printf("Error: environment variable %s named by -uri-env is empty or unset\n", *uriEnv)
+			os.Exit(exitConfigError)
+		}
+	}
+	if *uriFile != "" {
+		contents, err := os.ReadFile(*uriFile)
+		if err != nil {
+			fmt.Printf("Error: failed to read -uri-file: %v\n", err)
+			os.Exit(exitConfigError)
+		}
+		uris = uriList{strings.TrimSpace(string(contents))}
+		if uris[0] == "" {
+			fmt.Printf("Error: -uri-file %s is empty\n", *uriFile)
+			os.Exit(exitConfigError)
+		}
+	}
+
+	// Split off the labels of label=URI targets
+	uriLabels := make([]string, len(uris))
+	for i, uri := range uris {
+		uriLabels[i], uris[i] = splitURILabel(uri)
+	}
+	if configTargets {
+		for _, target := range config.Targets {
+			uris = append(uris, target.URI)
+			uriLabels = append(uriLabels, target.Name)
+		}
+	}
+	pgURI := &uris[0]
+
+	// Fill in the {{key}} placeholders, so one URI template can serve every environment
+	for i := range uris {
+		var err error
+		if uris[i], err = dsn.ExpandPlaceholders(uris[i], vars); err != nil {
+			fmt.Printf("Error: URI %d: %v\n", i+1, err)
+			os.Exit(exitConfigError)
+		}
+	}
+	if *standby != "" {
+		var err error
+		if *standby, err = dsn.ExpandPlaceholders(*standby, vars); err != nil {
+			fmt.Printf("Error: standby URI: %v\n", err)
+			os.Exit(exitConfigError)
+		}
+	}
+
+	// A URI listing several hosts connects to the first, failing over to the others in order
+	var failoverHosts []string
+	if len(uris) == 1 {
+		if first, hosts := dsn.SplitHosts(uris[0]); len(hosts) > 1 {
+			uris[0], failoverHosts = first, hosts[1:]
+		}
+	}
+	for _, host := range strings.Split(*failover, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			failoverHosts = append(failoverHosts, host)
+		}
+	}
+
+	// Fill in what each URI leaves unset from the PG* variables, as libpq would, so the DNS timing,
+	// target names, and banner see the server lib/pq connects to. Then catch a mistyped URI now
+	// rather than as a connection error after the first interval.
+	resolveURI := func(uri string) (string, error) {
+		if *driver != conntester.DefaultDriver {
+			return uri, nil
+		}
+		merged, err := dsn.WithEnvDefaults(uri)
+		if err == nil {
+			err = dsn.Validate(merged)
+		}
+		if err != nil {
+			return "", fmt.Errorf("invalid connection URI %s: %s", dsn.Redact(uri), dsn.RedactError(err, uri))
+		}
+		return merged, nil
+	}
+	if *driver == conntester.DefaultDriver {
+		checkURI := func(uri string) string {
+			merged, err := resolveURI(uri)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(exitConfigError)
+			}
+			return merged
+		}
+		for i := range uris {
+			uris[i] = checkURI(uris[i])
+		}
+		if *standby != "" {
+			*standby = checkURI(*standby)
+		}
+	}
+
+	// Parse the cron schedule up front so a bad expression fails before anything runs
+	var schedule cron.Schedule
+	if *cronSpec != "" {
+		if *repeat > 0 {
+			fmt.Println("Error: -cron and -repeat cannot be used together")
+			flag.Usage()
+			os.Exit(exitConfigError)
+		}
+
+		var err error
+		schedule, err = cron.ParseStandard(*cronSpec)
+		if err != nil {
+			fmt.Printf("Error: invalid -cron expression: %v\n", err)
+			os.Exit(exitConfigError)
+		}
+	}
+
+	if !slices.Contains(sql.Drivers(), *driver) {
+		fmt.Printf("Error: unknown -driver %q (registered drivers: %s)\n", *driver, strings.Join(sql.Drivers(), ", "))
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// These options rely on lib/pq or PostgreSQL-specific SQL
+	sslFlags := []struct{ name, param, value string }{
+		{"-sslmode", "sslmode", *sslMode},
+		{"-sslrootcert", "sslrootcert", *sslRootCert},
+		{"-sslcert", "sslcert", *sslCert},
+		{"-sslkey", "sslkey", *sslKey},
+	}
+	sslSet := *sslMode != "" || *sslRootCert != "" || *sslCert != "" || *sslKey != ""
+	if *driver != conntester.DefaultDriver && (sslSet || *tlsServerName != "" || *sourceAddr != "" || *trackLocalPort || *requirePrimary || *detectRole || *detectVersion || *detectSkew || *minNodes > 0 ||
+		*measureServerLoad || *pgBouncer || *trackBackends || *dbNames != "" || *proxyURL != "" || *checkCert || *explain) {
+		fmt.Printf("Error: the -ssl* flags, -tls-servername, -source-addr, -track-local-port, -require-primary, -detect-role, -detect-version, -detect-skew, -min-nodes, -measure-server-load, -pgbouncer, -track-backends, -dbnames, -proxy, -check-cert, and -explain require -driver %s\n", conntester.DefaultDriver)
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+	if *clientID != "" && *driver != conntester.DefaultDriver && *driver != "mysql" {
+		fmt.Printf("Error: -client-id requires -driver %s or mysql\n", conntester.DefaultDriver)
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *certWarnDays < 0 || (*certWarnDays > 0 && !*checkCert) {
+		fmt.Println("Error: -cert-warn-days cannot be negative and requires -check-cert")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// Catch a malformed proxy URL now rather than as a failure of every attempt
+	if *proxyURL != "" {
+		u, err := url.Parse(*proxyURL)
+		if err != nil || (u.Scheme != "socks5" && u.Scheme != "socks5h") || u.Host == "" {
+			fmt.Println("Error: -proxy must be a SOCKS5 URL such as socks5://host:1080")
+			os.Exit(exitConfigError)
+		}
+	}
+
+	// Check the source address is local now, rather than failing every connection with a bind error
+	if *sourceAddr != "" {
+		if net.ParseIP(*sourceAddr) == nil {
+			fmt.Println("Error: -source-addr must be an IP address")
+			flag.Usage()
+			os.Exit(exitConfigError)
+		}
+		listener, err := net.Listen("tcp", net.JoinHostPort(*sourceAddr, "0"))
+		if err != nil {
+			fmt.Printf("Error: -source-addr %s cannot be bound: %v\n", *sourceAddr, err)
+			os.Exit(exitConfigError)
+		}
+		listener.Close()
+	}
+
+	// Per-target state and the fallback URI assume a single database
+	if *dbNames != "" && (*rampDown > 0 || *concurrency > 0 || *breakerThreshold > 0 || *standby != "" || *recoveryEvents || *healthScore || *webhookURL != "") {
+		fmt.Println("Error: -dbnames cannot be combined with -ramp-down, -concurrency, -breaker-threshold, -standby, -recovery-events, -health-score, or -webhook-url")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *maxBackoff != 0 && (*repeat <= 0 || *maxBackoff < time.Duration(*repeat*float64(time.Second))) {
+		fmt.Println("Error: -max-backoff requires -repeat and must be at least the repeat delay")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *output != "prometheus" && (*promTextfile != "" || *promPushgateway != "") {
+		fmt.Println("Error: -prom-textfile and -prom-pushgateway require -output prometheus")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+	if *output != "otlp" && *otlpEndpoint != "" {
+		fmt.Println("Error: -otlp-endpoint requires -output otlp")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+	switch *output {
+	case "statsd":
+		if *timestampMetrics {
+			fmt.Println("Error: -timestamp-metrics requires -output prometheus or otlp; StatsD metrics carry no timestamp")
+			flag.Usage()
+			os.Exit(exitConfigError)
+		}
+	case "prometheus":
+		if *promTextfile == "" && *promPushgateway == "" && *httpAddr == "" {
+			fmt.Println("Error: -output prometheus requires -prom-textfile, -prom-pushgateway, or -http-addr")
+			flag.Usage()
+			os.Exit(exitConfigError)
+		}
+		if *verifyMetrics {
+			fmt.Println("Error: -verify-metrics checks the StatsD socket and cannot be used with -output prometheus")
+			flag.Usage()
+			os.Exit(exitConfigError)
+		}
+		if *timestampMetrics && *httpAddr == "" {
+			fmt.Println("Error: -timestamp-metrics with -output prometheus requires -http-addr; the textfile collector and the Pushgateway reject timestamps")
+			flag.Usage()
+			os.Exit(exitConfigError)
+		}
+	case "otlp":
+		if *otlpEndpoint == "" {
+			fmt.Println("Error: -output otlp requires -otlp-endpoint")
+			flag.Usage()
+			os.Exit(exitConfigError)
+		}
+		if *verifyMetrics {
+			fmt.Println("Error: -verify-metrics checks the StatsD socket and cannot be used with -output otlp")
+			flag.Usage()
+			os.Exit(exitConfigError)
+		}
+	default:
+		fmt.Printf("Error: unknown -output %q (expected statsd, prometheus, or otlp)\n", *output)
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *dryRun && *verifyMetrics {
+		fmt.Println("Error: -verify-metrics sends to the StatsD socket and cannot be used with -dry-run")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *breakerThreshold < 0 || (*breakerThreshold > 0 && (*repeat <= 0 || *breakerInterval <= 0)) {
+		fmt.Println("Error: -breaker-threshold cannot be negative and requires -repeat and a positive -breaker-interval")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+	if *heartbeatInterval < 0 {
+		fmt.Println("Error: -heartbeat-interval cannot be negative")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *statsdBuffer < 0 || *statsdFlushInterval < 0 {
+		fmt.Println("Error: -statsd-buffer and -statsd-flush-interval cannot be negative")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *flushTimeout <= 0 {
+		fmt.Println("Error: -flush-timeout must be positive")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *warmup < 0 {
+		fmt.Println("Error: -warmup cannot be negative")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+	if *concurrency < 0 || (*concurrency > 0 && *loadDuration <= 0) {
+		fmt.Println("Error: -concurrency cannot be negative and -duration must be positive")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+	if *concurrency > 0 && (*repeat > 0 || schedule != nil || *count > 0 || *untilFailure || *rampDown > 0) {
+		fmt.Println("Error: -concurrency cannot be combined with -repeat, -cron, -count, -until-failure, or -ramp-down")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// The standby is connected anew on every failover, and -ramp-down and -concurrency need many connections
+	if *keepalive < 0 || (*keepalive > 0 && (*repeat > 0 || schedule != nil || *count > 0 || *untilFailure || *rampDown > 0 || *concurrency > 0 || *persistent ||
+		*standby != "" || len(uris) > 1 || *dbNames != "")) {
+		fmt.Println("Error: -keepalive cannot be negative or combined with -repeat, -cron, -count, -until-failure, -ramp-down, -concurrency, -persistent, -standby, multiple URIs, or -dbnames")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *credentialFile != "" && (!*persistent || *driver != conntester.DefaultDriver) {
+		fmt.Printf("Error: -credential-file requires -persistent and -driver %s\n", conntester.DefaultDriver)
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+	// Failover replaces the standby, and needs a new connection to each host it tries
+	if len(failoverHosts) > 0 && (*standby != "" || *persistent || len(uris) > 1) {
+		fmt.Println("Error: -failover and multi-host URIs cannot be combined with -standby, -persistent, or multiple URIs")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *prewarm < 0 || (*prewarm > 0 && !*persistent) {
+		fmt.Println("Error: -prewarm must not be negative, and requires -persistent")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+	if *reconnectOnError && !*persistent {
+		fmt.Println("Error: -reconnect-on-error requires -persistent")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *persistent && (*standby != "" || *rampDown > 0 || *concurrency > 0) {
+		fmt.Println("Error: -persistent cannot be combined with -standby, -ramp-down, or -concurrency")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// Concurrent targets share no per-target state, so the stateful options are single-target only
+	if len(uris) > 1 && (*dbNames != "" || *rampDown > 0 || *concurrency > 0 || *breakerThreshold > 0 || *standby != "" || *recoveryEvents || *healthScore || *webhookURL != "" || *trackBackends || *explain || *hashResult) {
+		fmt.Println("Error: multiple -uri values cannot be combined with -dbnames, -ramp-down, -concurrency, -breaker-threshold, -standby, -recovery-events, -health-score, -webhook-url, -track-backends, -explain, or -hash-result")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// Streaming and row counting read past the first row without scanning it
+	if *expect != "" && (*rowTimeout > 0 || *expectSingleRow) {
+		fmt.Println("Error: -expect cannot be combined with -row-timeout or -expect-single-row")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+	if err := conntester.CheckExpect(*expect); err != nil {
+		fmt.Printf("Error: invalid -expect %q: %v\n", *expect, err)
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// Row count bounds are checked by counting the rows instead of scanning the first
+	var rowBounds *conntester.RowBounds
+	if *expectRows >= 0 || *minRows >= 0 || *maxRows >= 0 {
+		if *expectRows >= 0 && (*minRows >= 0 || *maxRows >= 0) {
+			fmt.Println("Error: -expect-rows cannot be combined with -min-rows or -max-rows")
+			flag.Usage()
+			os.Exit(exitConfigError)
+		}
+		if *expect != "" || *rowTimeout > 0 || *expectSingleRow || *queryFile != "" || *txProbe || *noQuery {
+			fmt.Println("Error: -expect-rows, -min-rows, and -max-rows cannot be combined with -expect, -row-timeout, -expect-single-row, -query-file, -tx-probe, or -no-query")
+			flag.Usage()
+			os.Exit(exitConfigError)
+		}
+		rowBounds = &conntester.RowBounds{Min: max(0, *minRows), Max: max(-1, *maxRows)}
+		if *expectRows >= 0 {
+			rowBounds.Min, rowBounds.Max = *expectRows, *expectRows
+		}
+		if rowBounds.Max >= 0 && rowBounds.Min > rowBounds.Max {
+			fmt.Println("Error: -min-rows cannot exceed -max-rows")
+			flag.Usage()
+			os.Exit(exitConfigError)
+		}
+	}
+
+	// An empty result is detected by counting the rows instead of scanning the first
+	if *failIfEmpty && (*expect != "" || *rowTimeout > 0 || *expectSingleRow || rowBounds != nil || *queryFile != "" || *txProbe || *noQuery) {
+		fmt.Println("Error: -fail-if-empty cannot be combined with -expect, -row-timeout, -expect-single-row, -expect-rows, -min-rows, -max-rows, -query-file, -tx-probe, or -no-query")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// The result is hashed by reading it in place of the other ways of reading it
+	if *hashResult && (*expect != "" || *rowTimeout > 0 || *expectSingleRow || rowBounds != nil || *failIfEmpty || *queryFile != "" || *txProbe || *noQuery) {
+		fmt.Println("Error: -hash-result cannot be combined with -expect, -row-timeout, -expect-single-row, -expect-rows, -min-rows, -max-rows, -fail-if-empty, -query-file, -tx-probe, or -no-query")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *payloadSize < 0 {
+		fmt.Println("Error: -payload-size cannot be negative")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// Only the readers that read rows one by one can stop partway
+	if *maxResultBytes < 0 {
+		fmt.Println("Error: -max-result-bytes must not be negative")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+	if *maxResultBytes > 0 && (*queryFile != "" || *txProbe || (*rowTimeout == 0 && !*expectSingleRow && rowBounds == nil && !*failIfEmpty && !*hashResult)) {
+		fmt.Println("Error: -max-result-bytes requires -row-timeout, -expect-single-row, -expect-rows, -min-rows, -max-rows, -fail-if-empty, or -hash-result, and cannot be combined with -query-file or -tx-probe")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// The plan explained is that of -query
+	if *explain && (*queryFile != "" || *noQuery) {
+		fmt.Println("Error: -explain cannot be combined with -query-file or -no-query")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+	if *explainBaseline != "" && !*explain {
+		fmt.Println("Error: -explain-baseline requires -explain")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *noQuery && (*query != conntester.DefaultQuery || *queryFile != "" || *expect != "" || *rowTimeout > 0 || *expectSingleRow || *queryInterval > 1 || *txProbe) {
+		fmt.Println("Error: -no-query cannot be combined with -query, -query-file, -expect, -row-timeout, -expect-single-row, -query-interval, or -tx-probe")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// The transaction probe scans the first column like a plain query, and a script already controls its own transactions
+	if *txProbe && (*queryFile != "" || *rowTimeout > 0 || *expectSingleRow) {
+		fmt.Println("Error: -tx-probe cannot be combined with -query-file, -row-timeout, or -expect-single-row")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// A script's statements are executed without reading their results
+	var script []string
+	if *queryFile != "" {
+		if *query != conntester.DefaultQuery || *expect != "" || *rowTimeout > 0 || *expectSingleRow {
+			fmt.Println("Error: -query-file cannot be combined with -query, -expect, -row-timeout, or -expect-single-row")
+			flag.Usage()
+			os.Exit(exitConfigError)
+		}
+		contents, err := os.ReadFile(*queryFile)
+		if err != nil {
+			fmt.Printf("Error: failed to read -query-file: %v\n", err)
+			os.Exit(exitConfigError)
+		}
+		script = splitStatements(string(contents))
+		if len(script) == 0 {
+			fmt.Printf("Error: -query-file %s has no statements\n", *queryFile)
+			os.Exit(exitConfigError)
+		}
+	}
+
+	// A script's own BEGIN and COMMIT are made read-only through the PostgreSQL session
+	if *readOnly && (*noQuery || (*queryFile != "" && *driver != conntester.DefaultDriver)) {
+		fmt.Printf("Error: -read-only cannot be combined with -no-query, and with -query-file requires -driver %s\n", conntester.DefaultDriver)
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// A script manages its own transactions and a transaction probe commits
+	if *rollback && (*queryFile != "" || *txProbe || *noQuery) {
+		fmt.Println("Error: -rollback cannot be combined with -query-file, -tx-probe, or -no-query")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *maxConnectionLatency < 0 || *maxQueryLatency < 0 {
+		fmt.Println("Error: -max-connection-latency and -max-query-latency cannot be negative")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *count < 0 || *maxFailures < 0 {
+		fmt.Println("Error: -count and -max-failures cannot be negative")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+	if *count > 0 && (schedule != nil || *rampDown > 0 || *untilFailure) {
+		fmt.Println("Error: -count cannot be combined with -cron, -ramp-down, or -until-failure")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *maxRuntime < 0 || (*maxRuntime > 0 && (*repeat <= 0 || *untilFailure)) {
+		fmt.Println("Error: -max-runtime cannot be negative and requires -repeat without -until-failure")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// Config targets with their own interval are each probed on their own schedule
+	scheduled := false
+	if configTargets {
+		for _, target := range config.Targets {
+			scheduled = scheduled || target.interval > 0
+		}
+	}
+	if scheduled && (*repeat <= 0 || *untilFailure || *maxBackoff > 0 || *breakerThreshold > 0 || *queryInterval > 1) {
+		fmt.Println("Error: -config target intervals require -repeat and cannot be combined with -until-failure, -max-backoff, -breaker-threshold, or -query-interval")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// The window is kept by the repeat loop only
+	if window.enabled() && (*repeat <= 0 || *untilFailure || *rampDown > 0 || scheduled) {
+		fmt.Println("Error: -window requires -repeat and cannot be combined with -until-failure, -ramp-down, or -config target intervals")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// The failure line describes a single attempt per target
+	if *errorJSON && (*repeat > 0 || schedule != nil || *count > 0 || *untilFailure || *rampDown > 0 || *concurrency > 0 || *keepalive > 0) {
+		fmt.Println("Error: -error-json applies to one-shot runs and cannot be combined with -repeat, -cron, -count, -until-failure, -ramp-down, -concurrency, or -keepalive")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// Only these runs keep the summary the file is written from
+	if *jsonSummary != "" && ((*repeat <= 0 && *count == 0 && *concurrency == 0) || *untilFailure || schedule != nil || *rampDown > 0) {
+		fmt.Println("Error: -json-summary requires -repeat, -count, or -concurrency and cannot be combined with -until-failure, -cron, or -ramp-down")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	switch *batchMode {
+	case "":
+		if len(uris) == 1 {
+			*batchMode = "sequential"
+		} else {
+			*batchMode = "parallel"
+		}
+	case "sequential", "parallel", "bounded":
+		if scheduled {
+			fmt.Println("Error: -batch-mode cannot be combined with -config target intervals, which probe each target on its own schedule")
+			flag.Usage()
+			os.Exit(exitConfigError)
+		}
+	default:
+		fmt.Printf("Error: unknown -batch-mode %q (expected sequential, parallel, or bounded)\n", *batchMode)
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+	if (*batchMode == "bounded") != (*batchConcurrency > 0) || *batchConcurrency < 0 {
+		fmt.Println("Error: -batch-mode bounded requires a positive -batch-concurrency, which applies to it only")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+	// The server tracker is shared by the -dbnames targets, and not safe for concurrent use
+	if *batchMode != "sequential" && *dbNames != "" && *trackBackends {
+		fmt.Println("Error: -track-backends with -dbnames requires -batch-mode sequential")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if (*seed != 0 && !*randomize) || (*randomize && scheduled) {
+		fmt.Println("Error: -seed requires -randomize, which cannot be combined with -config target intervals")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// The table holds the single attempt of each target
+	if *matrix && (*repeat > 0 || schedule != nil || *count > 0 || *untilFailure || *rampDown > 0 || *concurrency > 0 || *keepalive > 0 || scheduled) {
+		fmt.Println("Error: -matrix probes each target once and cannot be combined with -repeat, -cron, -count, -until-failure, -ramp-down, -concurrency, -keepalive, or -config target intervals")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *untilFailure && (schedule != nil || *rampDown > 0) {
+		fmt.Println("Error: -until-failure cannot be combined with -cron or -ramp-down")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *retries < 0 || *retryDelay < 0 {
+		fmt.Println("Error: -retries and -retry-delay cannot be negative")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *queryInterval < 1 {
+		fmt.Println("Error: -query-interval must be at least 1")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// Catch a missing certificate or key file now rather than as a failure of every attempt
+	for _, f := range sslFlags {
+		if f.value == "" || f.param == "sslmode" {
+			continue
+		}
+		if _, err := os.Stat(f.value); err != nil {
+			fmt.Printf("Error: %s file: %v\n", f.name, err)
+			os.Exit(exitConfigError)
+		}
+	}
+
+	// setURIParams applies the connection parameters the flags set to a URI: the TLS flags,
+	// overriding the URI's own, the application name unless the URI has one, and the client
+	// identifier, which identifies the probe to the server in server-side monitoring
+	setURIParams := func(uri string) (string, error) {
+		var err error
+		for _, f := range sslFlags {
+			if f.value == "" {
+				continue
+			}
+			if uri, err = dsn.SetParam(uri, f.param, f.value); err != nil {
+				return "", fmt.Errorf("failed to set %s: %w", f.param, err)
+			}
+		}
+		if *appName != "" && *driver == conntester.DefaultDriver {
+			if uri, err = dsn.WithDefaultParam(uri, "application_name", *appName); err != nil {
+				return "", fmt.Errorf("failed to set application name: %w", err)
+			}
+		}
+		if *clientID != "" && *driver == "mysql" {
+			if uri, err = withMySQLProgramName(uri, *clientID); err != nil {
+				return "", fmt.Errorf("failed to set client identifier: %w", err)
+			}
+		} else if *clientID != "" {
+			if uri, err = dsn.SetParam(uri, "application_name", *clientID); err != nil {
+				return "", fmt.Errorf("failed to set client identifier: %w", err)
+			}
+		}
+		return uri, nil
+	}
+
+	// prepareURI turns a target's URI into the one probed: the flags' parameters are set, and with
+	// -credential-file, the current password is used from the start, with later rotations picked
+	// up on authentication failures
+	prepareURI := func(uri string) (string, error) {
+		uri, err := setURIParams(uri)
+		if err == nil && *credentialFile != "" {
+			uri, err = conntester.ReadCredentialFile(uri, *credentialFile)
+		}
+		return uri, err
+	}
+	for i := range uris {
+		var err error
+		if uris[i], err = prepareURI(uris[i]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(exitConfigError)
+		}
+	}
+	if *standby != "" {
+		var err error
+		if *standby, err = setURIParams(*standby); err != nil {
+			fmt.Printf("Error: standby URI: %v\n", err)
+			os.Exit(exitConfigError)
+		}
+	}
+
+	// Write log lines as JSON objects for log pipelines
+	switch *logFormat {
+	case "text":
+	case "json":
+		// Timestamps move into the JSON objects
+		log.SetFlags(0)
+		log.SetOutput(&jsonLogWriter{out: os.Stderr})
+	default:
+		fmt.Printf("Error: unknown -log-format %q (expected text or json)\n", *logFormat)
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// The template formats the text line, which JSON output replaces
+	var failureTemplate *template.Template
+	if *errorTemplate != "" {
+		if *logFormat == "json" {
+			fmt.Println("Error: -error-template cannot be combined with -log-format json")
+			flag.Usage()
+			os.Exit(exitConfigError)
+		}
+		tmpl, err := template.New("error").Option("missingkey=error").Parse(*errorTemplate)
+		if err != nil {
+			fmt.Printf("Error: invalid -error-template: %v\n", err)
+			flag.Usage()
+			os.Exit(exitConfigError)
+		}
+		failureTemplate = tmpl
+	}
+
+	if *verbose && *quiet {
+		fmt.Println("Error: -v and -quiet cannot be combined")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *sampleRate <= 0 || *sampleRate > 1 {
+		fmt.Println("Error: -sample-rate must be greater than 0 and at most 1")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+	if *sampleRate != 1 && *output != "statsd" {
+		fmt.Println("Error: -sample-rate applies to -output statsd only")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	if *metricType != "distribution" && *metricType != "histogram" {
+		fmt.Printf("Error: unknown -metric-type %q (expected distribution or histogram)\n", *metricType)
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+	if *metricType != "distribution" && *output != "statsd" {
+		fmt.Println("Error: -metric-type applies to -output statsd only")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// Metric names are <namespace>.<metric-prefix>.<metric>
+	if *namespace != "" && !strings.HasSuffix(*namespace, ".") {
+		*namespace += "."
+	}
+	if *metricPrefix == "" {
+		fmt.Println("Error: -metric-prefix cannot be empty")
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	// Initialize the metrics backend
+	var client conntester.Backend
+	var promBackend *conntester.PrometheusBackend
+	var err error
+	catalog := conntester.NewCatalogBackend()
+	switch {
+	case *listMetrics:
+		catalog.Histograms = *metricType == "histogram"
+		client = catalog
+	case *dryRun:
+		writerBackend := conntester.NewWriterBackend(os.Stdout)
+		writerBackend.Histograms = *metricType == "histogram"
+		client = writerBackend
+	case *output == "prometheus":
+		promBackend = conntester.NewPrometheusBackend(*promTextfile, *promPushgateway, *promJob)
+		client = promBackend
+	case *output == "otlp":
+		client, err = conntester.NewOTLPBackend(context.Background(), *otlpEndpoint)
+		if err != nil {
+			fmt.Printf("Error: failed to initialize OTLP exporter: %v\n", err)
+			os.Exit(exitMetricsError)
+		}
+	default:
+		var statsdOptions []statsd.Option
+		if *statsdBuffer > 0 {
+			statsdOptions = append(statsdOptions, statsd.WithMaxMessagesPerPayload(*statsdBuffer))
+		}
+		if *statsdFlushInterval > 0 {
+			statsdOptions = append(statsdOptions, statsd.WithBufferFlushInterval(*statsdFlushInterval))
+		}
+		// One client per address, each sent every metric
+		var statsdBackends []conntester.Backend
+		for _, addr := range statsdAddrs.addrs {
+			statsdClient, err := newStatsdClient(addr, statsdOptions...)
+			if err != nil {
+				fmt.Printf("Error: failed to initialize StatsD client for %s: %v\n", addr, err)
+				os.Exit(exitMetricsError)
+			}
+
+			// Set client namespace prefix
+			statsdClient.Namespace = *namespace
+			statsdBackend := conntester.NewStatsdBackend(statsdClient)
+			statsdBackend.SampleRate = *sampleRate
+			statsdBackend.Histograms = *metricType == "histogram"
+			statsdBackends = append(statsdBackends, statsdBackend)
+		}
+		client = statsdBackends[0]
+		if len(statsdBackends) > 1 {
+			client = conntester.NewFanoutBackend(statsdBackends...)
+		}
+	}
+	defer client.Close()
+
+	// The StatsD client applies the namespace itself; the other backends get it from the renaming
+	metricNamespace := *namespace
+	if *output == "statsd" && !*dryRun && !*listMetrics {
+		metricNamespace = ""
+	}
+	renamed := conntester.NewRenamedBackend(client, metricNamespace, *metricPrefix)
+	if *namespace != "" || *metricPrefix != conntester.MetricStem {
+		client = renamed
+	}
+
+	// Drop the chosen tags by metric before renaming, so they are matched against the usual names
+	if len(dropTags) > 0 {
+		client = conntester.NewTagFilterBackend(client, dropTags)
+	}
+
+	// Fail fast if metrics cannot reach the StatsD socket
+	if *verifyMetrics && !*listMetrics {
+		preflightMetric := *namespace + renamed.MetricName(conntester.PreflightMetric)
+		for _, addr := range statsdAddrs.addrs {
+			sentinel, err := verifyMetricsPipeline(addr, preflightMetric)
+			if err != nil {
+				fmt.Printf("Error: metrics preflight to %s failed: %v\n", addr, err)
+				os.Exit(exitMetricsError)
+			}
+			log.Printf("Metrics preflight sent %s with tag sentinel:%s to %s", preflightMetric, sentinel, addr)
+		}
+	}
+
+	// With a StatsD flush interval, the client sends batches on its own schedule rather than
+	// being flushed after every attempt
+	flushEachAttempt := *statsdFlushInterval == 0 || *output != "statsd" || *dryRun
 
-	// Validate required parameters
-	if *pgURI == "" {
-		fmt.Println("Error: PostgreSQL URI is required")
-		flag.Usage()
-		os.Exit(1)
+	// exitFailure flushes buffered metrics so the failure reaches the aggregator before the process exits
+	exitFailure := func() {
+		if !*noFlushOnExit {
+			flushWithTimeout(client, *flushTimeout)
+		}
+		os.Exit(exitConnectionFailure)
+	}
+
+	// Parse custom tags, layered over any defaults from the environment, lowest precedence first
+	tagSources := []struct{ name, tags string }{{defaultTagsEnv, os.Getenv(defaultTagsEnv)}}
+	if *tagsEnv != "" {
+		// DD_TAGS-style variables may separate tags with spaces as well as commas
+		envTags := strings.Join(strings.Fields(strings.ReplaceAll(os.Getenv(*tagsEnv), ",", " ")), ",")
+		tagSources = append(tagSources, struct{ name, tags string }{*tagsEnv, envTags})
+	}
+	tagSources = append(tagSources, struct{ name, tags string }{"-tags", *tags})
+
+	var customTags []string
+	if *autoHostTag {
+		hostname, err := os.Hostname()
+		if err != nil {
+			fmt.Printf("Error: -auto-host-tag cannot read the hostname: %v\n", err)
+			os.Exit(exitConfigError)
+		}
+		customTags = []string{"host:" + hostname}
 	}
+	for _, source := range tagSources {
+		// Catch typos such as env=prod, which would otherwise silently drop the tag
+		for _, problem := range conntester.TagProblems(source.tags) {
+			if *strictTags {
+				fmt.Printf("Error: malformed tag in %s: %s\n", source.name, problem)
+				os.Exit(exitConfigError)
+			}
+			log.Printf("Warning: malformed tag in %s: %s", source.name, problem)
+		}
+		customTags = conntester.MergeTags(customTags, conntester.ParseTags(source.tags))
+	}
+
+	opts := probeOptions{Options: conntester.Options{
+		Driver:               *driver,
+		Query:                *query,
+		Script:               script,
+		TxProbe:              *txProbe,
+		ReadOnly:             *readOnly,
+		Rollback:             *rollback,
+		QueryTimeout:         *queryTimeout,
+		Retries:              *retries,
+		RetryDelay:           *retryDelay,
+		TLSServerName:        *tlsServerName,
+		TrackLocalPort:       *trackLocalPort,
+		SourceAddr:           *sourceAddr,
+		Proxy:                *proxyURL,
+		StandbyURI:           *standby,
+		FailoverHosts:        failoverHosts,
+		RequirePrimary:       *requirePrimary,
+		DetectRole:           *detectRole,
+		DetectVersion:        *detectVersion,
+		DetectSkew:           *detectSkew,
+		CheckCert:            *checkCert,
+		CertWarnDays:         *certWarnDays,
+		MinNodes:             *minNodes,
+		SuccessSQLStates:     parseSQLStates(*successSQLStates),
+		RowTimeout:           *rowTimeout,
+		ExpectSingleRow:      *expectSingleRow,
+		FailIfEmpty:          *failIfEmpty,
+		MaxResultBytes:       *maxResultBytes,
+		RowCount:             rowBounds,
+		MaxConnectionLatency: *maxConnectionLatency,
+		MaxQueryLatency:      *maxQueryLatency,
+		Expect:               *expect,
+		SkipQuery:            *noQuery,
+		CredentialFile:       *credentialFile,
+		ReconnectOnError:     *reconnectOnError,
+		PayloadSize:          *payloadSize,
+		OutlierThreshold:     *outlierThreshold,
+		Hold:                 *hold,
+		HoldInterval:         *holdInterval,
+		EmitSequence:         *emitSequence,
+		TimestampMetrics:     *timestampMetrics,
+		MeasureLoad:          *measureServerLoad,
+		PgBouncer:            *pgBouncer,
+	}, jsonLog: *logFormat == "json", errorTemplate: failureTemplate, failOnQueryError: *failOnQueryError, outcome: &runOutcome{}}
+	switch {
+	case *verbose:
+		opts.verbosity = verbosityVerbose
+		opts.LogBackendPID = true
+		opts.LogQueryResult = true
+	case *quiet:
+		opts.verbosity = verbosityQuiet
+	}
+	if *trackBackends {
+		opts.Backends = conntester.NewBackendTracker()
+	}
+	if *explain {
+		opts.Plans = conntester.NewChangeTracker(*explainBaseline, false)
+	}
+	if *hashResult {
+		opts.ResultHashes = conntester.NewChangeTracker("", true)
+	}
+	if *recoveryEvents {
+		opts.Outages = &conntester.OutageTracker{}
+	}
+	if *healthScore {
+		opts.Health = conntester.NewHealthTracker(*healthWindow, *healthLatency, *healthSuccessWeight, *healthLatencyWeight)
+	}
+
+	// Derive a target name from the URI components if a template was given
+	if *nameTemplate != "" && len(uris) == 1 {
+		opts.TargetName, err = dsn.RenderTargetName(*nameTemplate, *pgURI)
+		if err != nil {
+			fmt.Printf("Error: failed to derive target name: %v\n", err)
+			os.Exit(exitConfigError)
+		}
+		customTags = append(customTags, "target:"+opts.TargetName)
+		log.SetPrefix(fmt.Sprintf("[%s] ", opts.TargetName))
+	}
+
+	// buildTargets turns the prepared URIs and their labels into the targets probed: the -uri
+	// database, each -uri database concurrently, or each of -dbnames on the same server. The
+	// config targets the URIs came from, if any, layer their own settings over the flags.
+	targetTags := customTags
+	buildTargets := func(uris, uriLabels []string, configured []targetConfig) ([]probeTarget, error) {
+		customTags := targetTags
+		targets := []probeTarget{{uri: uris[0], tags: customTags}}
+		if len(uris) > 1 {
+			targets = nil
+			for i, uri := range uris {
+				name, tag := uriLabels[i], ""
+				if name == "" && *nameTemplate != "" {
+					var err error
+					if name, err = dsn.RenderTargetName(*nameTemplate, uri); err != nil {
+						return nil, fmt.Errorf("failed to derive target name: %w", err)
+					}
+				}
+				if name != "" {
+					tag = "target:" + name
+				} else if components, err := dsn.ParseComponents(uri); err == nil && components.Host != "" {
+					name, tag = components.Host, "host:"+components.Host
+				} else {
+					name = fmt.Sprintf("uri%d", i+1)
+					tag = "target:" + name
+				}
+				targets = append(targets, probeTarget{
+					uri:  uri,
+					name: name,
+					tags: append(customTags[:len(customTags):len(customTags)], tag),
+				})
+			}
+		} else if *dbNames != "" {
+			targets = nil
+			for _, dbName := range strings.Split(*dbNames, ",") {
+				dbName = strings.TrimSpace(dbName)
+				if dbName == "" {
+					continue
+				}
+				dbURI, err := dsn.WithDBName(uris[0], dbName)
+				if err != nil {
+					return nil, fmt.Errorf("failed to set database %q: %w", dbName, err)
+				}
+				targets = append(targets, probeTarget{
+					uri:  dbURI,
+					tags: append(customTags[:len(customTags):len(customTags)], "dbname:"+dbName),
+				})
+			}
+		}
+
+		// Layer each config target's own settings over the flags. A single target applies to every -dbnames database.
+		if len(configured) > 0 {
+			for i := range targets {
+				target := configured[min(i, len(configured)-1)]
+				targets[i].tags = append(targets[i].tags[:len(targets[i].tags):len(targets[i].tags)], target.Tags...)
+				targets[i].query, targets[i].timeout, targets[i].interval = target.Query, target.timeout, target.interval
+			}
+		}
+
+		// Tag each target with the server and database its URI names, under the user's tags
+		if *bindTarget {
+			for i := range targets {
+				targets[i].tags = conntester.MergeTags(uriTags(targets[i].uri), targets[i].tags)
+			}
+		}
 
-	// Initialize StatsD client
-	client, err := statsd.New(*statsdAddr)
+		// Each target keeps its own connection open across attempts
+		if *persistent {
+			for i := range targets {
+				targets[i].persistent = &conntester.PersistentConn{}
+			}
+		}
+		return targets, nil
+	}
+	var configured []targetConfig
+	if configTargets {
+		configured = config.Targets
+	}
+	targets, err := buildTargets(uris, uriLabels, configured)
 	if err != nil {
-		log.Fatalf("Failed to initialize StatsD client: %v", err)
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitConfigError)
+	}
+	if *bindTarget && len(targets) == 1 {
+		customTags = conntester.MergeTags(uriTags(targets[0].uri), customTags)
 	}
-	defer client.Close()
 
-	// Set client namespace prefix
-	client.Namespace = ""
+	// List the metrics through the same renaming and tag filtering as a run, then exit
+	if *listMetrics {
+		listOpts := opts
+		if *rampDown > 0 || *concurrency > 0 {
+			listOpts = opts.withoutIterationState()
+		}
+		for _, target := range targets {
+			tester := conntester.Tester{URI: target.uri, Timeout: target.timeoutOr(*timeout), Backend: client, Tags: target.tags, Options: listOpts.Options}
+			tester.Options.Persistent = target.persistent
+			switch {
+			case *rampDown > 0:
+				tester.Tags = append(tester.Tags[:len(tester.Tags):len(tester.Tags)], "concurrency:1")
+				tester.DescribeMetrics()
+				client.Gauge(conntester.InflightMaxMetric, 0, tester.Tags)
+			case *concurrency > 0:
+				tester.DescribeMetrics()
+			case *keepalive > 0:
+				tester.DescribeKeepaliveMetrics()
+			default:
+				tester.DescribeMetrics()
+			}
+		}
+		if *emitZero {
+			conntester.EmitStartupBaseline(client, customTags)
+		}
+		if *heartbeatInterval > 0 {
+			client.Count(conntester.HeartbeatMetric, 0, customTags)
+		}
+		// The gauges set by the repeat, cron, and -count loop after every iteration
+		if *rampDown == 0 && *concurrency == 0 && *keepalive == 0 && (*repeat > 0 || schedule != nil || *count > 0 || *untilFailure) {
+			(&attemptStreak{}).emit(client, customTags)
+			client.Count(conntester.LoopExitMetric, 0, append(customTags[:len(customTags):len(customTags)], "reason:signal"))
+			if window.enabled() {
+				sample := &rollingWindow{size: window}
+				sample.record(0)
+				sample.emit(client, customTags)
+			}
+			if *breakerThreshold > 0 {
+				client.Count(conntester.AttemptCountMetric, 0, append(customTags[:len(customTags):len(customTags)], "status:circuit_open"))
+			}
+			if jitter.enabled() && *repeat > 0 && !*untilFailure && !scheduled {
+				client.Gauge(conntester.IntervalJitterMetric, 0, customTags)
+			}
+		}
+		printMetricCatalog(catalog.Metrics(), *logFormat == "json")
+		os.Exit(exitSuccess)
+	}
 
-	// Parse custom tags
-	customTags := parseTags(*tags)
+	// Record every attempt to a CSV file
+	if *csvPath != "" {
+		opts.csv, err = newCSVRecorder(*csvPath)
+		if err != nil {
+			fmt.Printf("Error: failed to open CSV file: %v\n", err)
+			os.Exit(exitConfigError)
+		}
+	}
 
-	// Test the connection once or repeatedly
-	if *repeat > 0 {
-		// If repeat is specified but very small, default to 1 second
-		delay := *repeat
-		if delay < 0.001 {
-			delay = 1.0
+	if *matrix {
+		names := make([]string, len(targets))
+		for i, target := range targets {
+			names[i] = target.name
+			if names[i] == "" {
+				names[i] = dsn.Redact(target.uri)
+			}
 		}
-		
-		fmt.Printf("Starting repeated connection tests every %.3f seconds...\n", delay)
-		ticker := time.NewTicker(time.Duration(delay * float64(time.Second)))
-		defer ticker.Stop()
+		opts.matrix = newMatrixTable(names)
+	}
 
-		for {
-			select {
-			case <-ticker.C:
-				runConnectionTest(*pgURI, *timeout, client, customTags)
+	// Notify a webhook on state changes
+	if *webhookURL != "" {
+		target := opts.TargetName
+		if target == "" {
+			components, err := dsn.ParseComponents(*pgURI)
+			if err != nil {
+				fmt.Printf("Error: failed to parse URI for webhook target: %v\n", err)
+				os.Exit(exitConfigError)
 			}
+			target = fmt.Sprintf("%s:%s/%s", components.Host, components.Port, components.DBName)
 		}
-	} else {
-		success, _ := runConnectionTest(*pgURI, *timeout, client, customTags)
 
-		if success {
-			os.Exit(0)
-		} else {
-			os.Exit(1)
+		opts.webhook, err = newWebhookNotifier(*webhookURL, target, *webhookTemplate, *webhookDebounce)
+		if err != nil {
+			fmt.Printf("Error: failed to configure webhook: %v\n", err)
+			os.Exit(exitConfigError)
 		}
 	}
-}
 
-func testConnection(pgURI string, timeoutSeconds int, client *statsd.Client, customTags []string) (bool, time.Duration, time.Duration) {
-	// Create a context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSeconds)*time.Second)
-	defer cancel()
+	// Serve the latest result for liveness and readiness probes, and the metrics for scraping
+	if *httpAddr != "" {
+		opts.health = &healthState{}
+		var metrics http.Handler
+		if promBackend != nil {
+			metrics = promBackend
+		}
+		if err := startHTTPServer(*httpAddr, opts.health, metrics); err != nil {
+			fmt.Printf("Error: failed to start HTTP server: %v\n", err)
+			os.Exit(exitConfigError)
+		}
+	}
+
+	// reloadTargets rereads the -config file's targets, which SIGHUP applies in scheduled runs.
+	// The file's other settings only take effect on a restart.
+	reloadTargets := func() ([]probeTarget, error) {
+		config, err := loadConfig(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(config.Targets) == 0 {
+			return nil, errors.New("no targets")
+		}
+		uris := make([]string, len(config.Targets))
+		uriLabels := make([]string, len(config.Targets))
+		for i, target := range config.Targets {
+			uri, err := dsn.ExpandPlaceholders(target.URI, vars)
+			if err == nil {
+				uri, err = resolveURI(uri)
+			}
+			if err == nil {
+				uri, err = prepareURI(uri)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("target %d: %w", i+1, err)
+			}
+			uris[i], uriLabels[i] = uri, target.Name
+		}
+		return buildTargets(uris, uriLabels, config.Targets)
+	}
+
+	// Give dashboards data from t0 instead of "no data" until the first attempt completes
+	if *emitZero {
+		conntester.EmitStartupBaseline(client, customTags)
+	}
 
-	// Record start time
-	startTime := time.Now()
+	// probeOne runs one attempt against target with its own settings layered over targetOpts
+	// Shuffles the target order before every pass with -randomize, nil to keep the given order
+	var shuffle *rand.Rand
+	shuffleSeed := *seed
+	if *randomize {
+		if shuffleSeed == 0 {
+			shuffleSeed = rand.Uint64()
+		}
+		shuffle = rand.New(rand.NewPCG(shuffleSeed, shuffleSeed))
+	}
 
-	// Open connection
-	db, err := sql.Open("postgres", pgURI)
-	if err != nil {
-		log.Printf("Failed to create database connection: %v", err)
+	probeOne := func(target probeTarget, backend conntester.Backend, targetOpts probeOptions) bool {
+		targetOpts.TargetName, targetOpts.Persistent = target.name, target.persistent
+		if target.query != "" {
+			targetOpts.Query = target.query
+		}
+		success, _ := runConnectionTest(target.uri, target.timeoutOr(*timeout), backend, target.tags, targetOpts)
+		return success
+	}
 
-		// Use a copy of customTags to avoid modifying the original
-		tags := make([]string, len(customTags))
-		copy(tags, customTags)
-		
-		// Emit metric with status:failure
-		statusAdded := false
-		for i, tag := range tags {
-			if strings.HasPrefix(tag, "status:") {
-				tags[i] = "status:failure"
-				statusAdded = true
-				break
+	// probeTargets runs one attempt against every target, one after another, all at once, or
+	// -batch-concurrency at a time as -batch-mode selects, and in a new random order each time
+	// with -randomize, and reports whether all of them succeeded. Metrics go to backend.
+	probeTargets := func(backend conntester.Backend) bool {
+		order := targets
+		if shuffle != nil {
+			order = slices.Clone(targets)
+			shuffle.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+		}
+		if *batchMode == "sequential" {
+			success := true
+			for _, target := range order {
+				if !probeOne(target, backend, opts) {
+					success = false
+				}
 			}
+			return success
 		}
-		
-		if !statusAdded {
-			tags = append(tags, "status:failure")
+
+		// Holds a slot per target being probed, so at most its capacity run at once
+		slots := len(order)
+		if *batchMode == "bounded" {
+			slots = *batchConcurrency
 		}
-		
-		if emitErr := client.Incr(attemptCountMetric, tags, 1); emitErr != nil {
-			log.Printf("Failed to emit failure metric: %v", emitErr)
+		semaphore := make(chan struct{}, slots)
+		var wg sync.WaitGroup
+		var failed atomic.Bool
+		for _, target := range order {
+			targetOpts := opts
+			semaphore <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-semaphore
+					wg.Done()
+				}()
+				if !probeOne(target, backend, targetOpts) {
+					failed.Store(true)
+				}
+			}()
 		}
-		return false, time.Since(startTime), 0
+		wg.Wait()
+		return !failed.Load()
 	}
-	defer db.Close()
 
-	// Ping to verify connection is successful and calculate connection time
-	err = db.PingContext(ctx)
+	// runIteration runs one attempt of the repeat or cron loop
+	iteration := 0
+	breaker := &circuitBreaker{threshold: *breakerThreshold, interval: *breakerInterval}
+	streak := &attemptStreak{}
+	runIteration := func() bool {
+		// Only run the test query on every queryInterval-th iteration
+		opts.SkipQuery = *noQuery || (*queryInterval > 1 && iteration%*queryInterval != 0)
+		iteration++
+		opts.Sequence = iteration
 
-	// Calculate elapsed time
-	elapsedTime := time.Since(startTime)
+		// While the breaker is open, hold the attempt's metrics back unless it recovers
+		backend := conntester.Backend(client)
+		var held *heldBackend
+		if breaker.open() {
+			held = &heldBackend{}
+			backend = held
+		}
 
-	// Determine success or failure
-	success := err == nil
-	status := "success"
-	if !success {
-		status = "failure"
-		log.Printf("Connection failed: %v", err)
+		success := probeTargets(backend)
+		streak.observe(success)
+		streak.emit(backend, customTags)
+		opts.window.emit(backend, customTags)
+
+		if held != nil && success {
+			held.replay(client)
+		} else if held != nil {
+			breaker.heartbeat(client, customTags)
+		}
+		breaker.observe(success)
+
+		// Publish after every attempt; the Prometheus backend only writes on flush
+		if flushEachAttempt {
+			if err := client.Flush(); err != nil {
+				log.Printf("Failed to flush metrics: %v", err)
+			}
+		}
+		return success
 	}
 
-	// Use a copy of customTags to avoid modifying the original
-	tags := make([]string, len(customTags))
-	copy(tags, customTags)
-	
-	// Add or replace status tag
-	statusAdded := false
-	for i, tag := range tags {
-		if strings.HasPrefix(tag, "status:") {
-			tags[i] = fmt.Sprintf("status:%s", status)
-			statusAdded = true
-			break
+	// loopExit counts the end of a repeat, cron, or -count loop with why it ended: signal,
+	// duration, count, or error, so a prober that died can be told apart from one shut down
+	loopExit := func(reason string) {
+		tags := append(customTags[:len(customTags):len(customTags)], "reason:"+reason)
+		if err := client.Count(conntester.LoopExitMetric, 1, tags); err != nil {
+			log.Printf("Failed to emit loop exit metric: %v", err)
 		}
 	}
-	
-	if !statusAdded {
-		tags = append(tags, fmt.Sprintf("status:%s", status))
+
+	// finishCount ends a -count or -max-runtime run, failing if more than -max-failures attempts
+	// failed. reason is the loop_exit reason, count or duration.
+	failures := 0
+	finishCount := func(reason string) {
+		loopExit(reason)
+		opts.summary.print()
+		opts.summaryFile.write(opts.summary)
+		if failures > *maxFailures {
+			fmt.Printf("%d of %d attempts failed (allowed: %d)\n", failures, iteration, *maxFailures)
+			exitFailure()
+		}
+		flushWithTimeout(client, *flushTimeout)
+		os.Exit(opts.outcome.successCode())
 	}
 
-	// Record connection latency as distribution
-	if err := client.Distribution(connectionLatencyMetric, elapsedTime.Seconds(), tags, 1); err != nil {
-		log.Printf("Failed to emit latency metric: %v", err)
+	// Say what is about to run, with passwords masked
+	redactedURIs := make([]string, len(targets))
+	for i, target := range targets {
+		redactedURIs[i] = dsn.Redact(target.uri)
+	}
+	metricsTarget := *output
+	switch {
+	case *dryRun:
+		metricsTarget = "stdout (dry run)"
+	case *output == "statsd":
+		metricsTarget += " " + strings.Join(statsdAddrs.addrs, ", ")
+	case *output == "otlp":
+		metricsTarget += " " + *otlpEndpoint
+	}
+	if *jsonSummary != "" {
+		summaryQuery := opts.Query
+		if summaryQuery == "" {
+			summaryQuery = conntester.DefaultQuery
+		}
+		opts.summaryFile = &summaryFile{path: *jsonSummary, config: summaryConfig{
+			URIs:          redactedURIs,
+			Driver:        *driver,
+			Query:         summaryQuery,
+			TimeoutMs:     millis(*timeout),
+			RepeatSeconds: *repeat,
+			Count:         *count,
+			MaxRuntimeMs:  millis(*maxRuntime),
+			Concurrency:   *concurrency,
+			Tags:          customTags,
+		}}
+	}
+	fmt.Printf("Probing %s with driver %s, timeout %v, metrics to %s\n", strings.Join(redactedURIs, ", "), *driver, *timeout, metricsTarget)
+	if *randomize {
+		fmt.Printf("Randomizing the target order with -seed %d\n", shuffleSeed)
+	}
+	if opts.verbosity == verbosityVerbose {
+		printConfiguration(targets, *timeout, customTags, opts)
 	}
 
-	// Record attempt count with final status
-	if err := client.Incr(attemptCountMetric, tags, 1); err != nil {
-		log.Printf("Failed to emit attempt metric: %v", err)
+	if *heartbeatInterval > 0 {
+		startHeartbeat(client, *heartbeatInterval, customTags)
 	}
 
-	// If connection was successful, run a test query and measure its latency
-	var queryLatency time.Duration
-	if success {
-		queryStart := time.Now()
-		var testResult int
-		err = db.QueryRowContext(ctx, "SELECT 1").Scan(&testResult)
-		queryLatency = time.Since(queryStart)
-		
-		if err != nil {
-			log.Printf("Test query failed: %v", err)
-			// Query failed, but connection was successful
-			queryTags := make([]string, len(customTags))
-			copy(queryTags, customTags)
-			
-			// Add query status failure
-			queryStatusAdded := false
-			for i, tag := range queryTags {
-				if strings.HasPrefix(tag, "status:") {
-					queryTags[i] = "status:query_failure"
-					queryStatusAdded = true
-					break
-				}
+	// Open each persistent connection's pool ahead of the first attempt, so it starts warm
+	if *prewarm > 0 {
+		for _, target := range targets {
+			tester := conntester.Tester{URI: target.uri, Timeout: target.timeoutOr(*timeout), Options: opts.Options}
+			tester.Options.Persistent = target.persistent
+			elapsed, err := tester.Prewarm(context.Background(), *prewarm)
+			if err != nil {
+				log.Printf("Failed to prewarm %d connections to %s: %s", *prewarm, dsn.Redact(target.uri), dsn.RedactError(err, target.uri))
+				continue
 			}
-			
-			if !queryStatusAdded {
-				queryTags = append(queryTags, "status:query_failure")
+			log.Printf("Prewarmed %d connections to %s in %v", *prewarm, dsn.Redact(target.uri), elapsed.Round(time.Microsecond))
+		}
+	}
+
+	// Warm up DNS, TLS session, and server caches with attempts that are not measured. The
+	// cross-attempt trackers and notifications only start with the measured attempts.
+	if *warmup > 0 {
+		fmt.Printf("Running %d warmup attempts...\n", *warmup)
+		measured := opts
+		opts.webhook, opts.health, opts.outcome, opts.csv, opts.matrix = nil, nil, nil, nil, nil
+		opts.Health, opts.Outages, opts.Backends, opts.EmitSequence = nil, nil, nil, false
+		for range *warmup {
+			probeTargets(discardBackend{})
+		}
+		opts = measured
+	}
+
+	// A panic in a loop is the silent prober death loop_exit is for, so count it before crashing
+	if *repeat > 0 || schedule != nil || *count > 0 || *untilFailure {
+		defer func() {
+			if r := recover(); r != nil {
+				loopExit("error")
+				flushWithTimeout(client, *flushTimeout)
+				panic(r)
 			}
-			
-			// Record query latency even on failure
-			if err := client.Distribution(queryLatencyMetric, queryLatency.Seconds(), queryTags, 1); err != nil {
-				log.Printf("Failed to emit query latency metric: %v", err)
+		}()
+	}
+
+	// Test the connection once, repeatedly, or on a cron schedule
+	if *rampDown > 0 {
+		fmt.Printf("Ramping concurrency down from %d to 1, %v per level...\n", *rampDown, *rampStep)
+		if runRampDown(*pgURI, *timeout, client, customTags, opts, *rampDown, *rampStep) {
+			flushWithTimeout(client, *flushTimeout)
+			os.Exit(exitSuccess)
+		}
+		exitFailure()
+	} else if *concurrency > 0 {
+		fmt.Printf("Load testing with %d workers for %v...\n", *concurrency, *loadDuration)
+		if runLoadTest(*pgURI, *timeout, client, customTags, opts, *concurrency, *loadDuration) {
+			flushWithTimeout(client, *flushTimeout)
+			os.Exit(exitSuccess)
+		}
+		exitFailure()
+	} else if *keepalive > 0 {
+		fmt.Printf("Checking whether connections survive %v idle...\n", *keepalive)
+		runKeepalive(*pgURI, *timeout, client, customTags, opts, *keepalive, *flushTimeout)
+		os.Exit(exitSuccess)
+	} else if *untilFailure {
+		var delay time.Duration
+		if *repeat > 0 {
+			delay = time.Duration(*repeat * float64(time.Second))
+		}
+
+		fmt.Println("Running connection tests until the first failure...")
+		opts.failure = &attemptFailure{}
+		start := time.Now()
+		for runIteration() {
+			time.Sleep(delay)
+		}
+		loopExit("error")
+		opts.failure.print(iteration, time.Since(start))
+		exitFailure()
+	} else if *count > 0 && *repeat == 0 {
+		fmt.Printf("Running %d connection tests back to back...\n", *count)
+		opts.summary = &latencySummary{}
+		for iteration < *count {
+			if !runIteration() {
+				failures++
 			}
-		} else {
-			// Query successful
-			queryTags := make([]string, len(customTags))
-			copy(queryTags, customTags)
-			
-			// Add query status success
-			queryStatusAdded := false
-			for i, tag := range queryTags {
-				if strings.HasPrefix(tag, "status:") {
-					queryTags[i] = "status:success"
-					queryStatusAdded = true
-					break
+		}
+		finishCount("count")
+	} else if scheduled {
+		fmt.Println("Starting connection tests with per-target intervals...")
+		opts.summary = &latencySummary{}
+		var sig os.Signal
+		started := time.Now()
+		iteration, failures, sig = runScheduledTargets(targets, time.Duration(*repeat*float64(time.Second)), *count, *maxRuntime,
+			func(target probeTarget, attempt int) bool {
+				targetOpts := opts
+				targetOpts.Sequence = attempt
+				success := probeOne(target, client, targetOpts)
+				if flushEachAttempt {
+					if err := client.Flush(); err != nil {
+						log.Printf("Failed to flush metrics: %v", err)
+					}
+				}
+				return success
+			}, reloadTargets)
+		if sig != nil {
+			loopExit("signal")
+			opts.summary.print()
+			opts.summaryFile.write(opts.summary)
+			flushWithTimeout(client, *flushTimeout)
+			fmt.Printf("Received %v, stopping connection tests\n", sig)
+			os.Exit(exitSuccess)
+		}
+		if *maxRuntime > 0 && time.Since(started) >= *maxRuntime {
+			finishCount("duration")
+		}
+		finishCount("count")
+	} else if *repeat > 0 {
+		// If repeat is specified but very small, default to 1 second
+		delay := *repeat
+		if delay < 0.001 {
+			delay = 1.0
+		}
+
+		fmt.Printf("Starting repeated connection tests every %.3f seconds...\n", delay)
+		backoff := &repeatBackoff{base: time.Duration(delay * float64(time.Second)), max: *maxBackoff, jitter: jitter}
+		// Fire the first attempt right away so data flows from the start, then every delay
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+
+		// Shut down cleanly on Ctrl-C or a supervisor's SIGTERM
+		opts.summary = &latencySummary{}
+		if window.enabled() {
+			opts.window = &rollingWindow{size: window}
+		}
+		shutdown := make(chan os.Signal, 1)
+		signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+
+		// Stop once -max-runtime has elapsed, or whenever -count is reached first; a nil
+		// channel never fires, so there is no deadline without -max-runtime
+		var deadline <-chan time.Time
+		if *maxRuntime > 0 {
+			deadline = time.After(*maxRuntime)
+		}
+
+		for {
+			select {
+			case <-timer.C:
+				started := time.Now()
+				success := runIteration()
+				if !success {
+					failures++
+				}
+				if *count > 0 && iteration >= *count {
+					finishCount("count")
+				}
+
+				// Keep the cadence of the base delay, measured from the start of the attempt
+				wait, offset := backoff.next(success)
+				if jitter.enabled() {
+					// How far -jitter moved the delay from the intended one, to confirm the jitter works
+					offsetMs := float64(offset.Microseconds()) / 1000
+					if err := client.Gauge(conntester.IntervalJitterMetric, offsetMs, customTags); err != nil {
+						log.Printf("Failed to emit interval jitter metric: %v", err)
+					}
 				}
+				if !success && backoff.max > 0 {
+					log.Printf("Attempt failed, backing off for %v", wait.Round(time.Millisecond))
+				}
+				timer.Reset(max(0, wait-time.Since(started)))
+			case <-deadline:
+				timer.Stop()
+				fmt.Printf("Maximum runtime of %v reached, stopping connection tests\n", *maxRuntime)
+				finishCount("duration")
+			case sig := <-shutdown:
+				timer.Stop()
+				loopExit("signal")
+				opts.summary.print()
+				opts.summaryFile.write(opts.summary)
+				flushWithTimeout(client, *flushTimeout)
+				fmt.Printf("Received %v, stopping connection tests\n", sig)
+				os.Exit(exitSuccess)
+			}
+		}
+	} else if schedule != nil {
+		fmt.Printf("Starting scheduled connection tests on cron schedule %q...\n", *cronSpec)
+		shutdown := make(chan os.Signal, 1)
+		signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+		for {
+			timer := time.NewTimer(time.Until(schedule.Next(time.Now())))
+			select {
+			case <-timer.C:
+				runIteration()
+			case sig := <-shutdown:
+				timer.Stop()
+				loopExit("signal")
+				flushWithTimeout(client, *flushTimeout)
+				fmt.Printf("Received %v, stopping connection tests\n", sig)
+				os.Exit(exitSuccess)
 			}
-			
-			if !queryStatusAdded {
-				queryTags = append(queryTags, "status:success")
+		}
+	} else {
+		opts.Sequence = 1
+		success := probeTargets(client)
+		if opts.matrix != nil {
+			opts.matrix.print()
+		}
+		if success {
+			flushWithTimeout(client, *flushTimeout)
+			code := opts.outcome.oneShotCode()
+			if *errorJSON {
+				opts.outcome.writeFailure(os.Stderr, code)
 			}
-			
-			// Record query latency
-			if err := client.Distribution(queryLatencyMetric, queryLatency.Seconds(), queryTags, 1); err != nil {
-				log.Printf("Failed to emit query latency metric: %v", err)
+			os.Exit(code)
+		} else {
+			if *errorJSON {
+				opts.outcome.writeFailure(os.Stderr, exitConnectionFailure)
 			}
+			exitFailure()
 		}
 	}
+}
+
+// probeOptions carries the probe behaviors selected on the command line, plus the
+// command's own per-attempt reporting
+type probeOptions struct {
+	conntester.Options
+	// Accumulates latencies for the shutdown summary, nil outside repeat mode
+	summary *latencySummary
+	// Where the summary is also written as JSON, nil unless -json-summary is set
+	summaryFile *summaryFile
+	// Recent connection latencies for the -window gauges, nil unless -window is set in repeat mode
+	window *rollingWindow
+	// Records the details of failed attempts, nil unless -until-failure is set
+	failure *attemptFailure
+	// State-change notifications, nil when disabled
+	webhook *webhookNotifier
+	// Latest results served on /healthz, nil when disabled
+	health *healthState
+	// Per-attempt rows for offline analysis, nil when disabled
+	csv *csvRecorder
+	// Single attempt of every target for the pass/fail table, nil unless -matrix is set
+	matrix *matrixTable
+	// Fail attempts whose test query failed, not only those that could not connect
+	failOnQueryError bool
+	// Write each attempt as a JSON object instead of a human-readable line
+	jsonLog bool
+	// Formats the line printed on a failed attempt, nil for the built-in message
+	errorTemplate *template.Template
+	// How much is printed about each attempt
+	verbosity verbosity
+	// Records what the exit code depends on, nil during warmup
+	outcome *runOutcome
+}
 
-	return success, elapsedTime, queryLatency
+// withoutIterationState returns the options for attempts that run concurrently. The
+// cross-iteration trackers are not safe for concurrent use, and the per-iteration gauges are
+// meaningless across concurrent attempts.
+func (o probeOptions) withoutIterationState() probeOptions {
+	o.Backends, o.Health, o.Outages, o.EmitSequence = nil, nil, nil, false
+	return o
 }
 
-func runConnectionTest(pgURI string, timeoutSeconds int, client *statsd.Client, customTags []string) (bool, time.Duration) {
-	success, latency, queryLatency := testConnection(pgURI, timeoutSeconds, client, customTags)
+// runConnectionTest runs one attempt against pgURI, records it, and prints its outcome
+func runConnectionTest(pgURI string, timeout time.Duration, client conntester.Backend, customTags []string, opts probeOptions) (bool, time.Duration) {
+	attemptID := newAttemptID()
+	tester := conntester.Tester{
+		URI:       pgURI,
+		Timeout:   timeout,
+		Backend:   client,
+		Tags:      customTags,
+		Options:   opts.Options,
+		AttemptID: attemptID,
+	}
+	result, err := tester.Run(context.Background())
+	success, status, latency, queryLatency := result.Success, result.Status, result.ConnectionLatency, result.QueryLatency
+
+	// A failed test query fails the attempt too, except an assertion or SLO breach, which have
+	// their own exit codes
+	queryFailed := success && opts.failOnQueryError && result.QueryStatus != "" && result.QueryStatus != "success" &&
+		result.QueryStatus != "slo_breach" && !isQueryAssertion(result.QueryStatus)
+	if queryFailed {
+		success, status = false, result.QueryStatus
+	}
+
+	if opts.webhook != nil {
+		opts.webhook.observe(success, latency)
+	}
+	if opts.health != nil {
+		opts.health.observe(pgURI, opts.TargetName, success, status, latency)
+	}
+	if opts.summary != nil {
+		opts.summary.record(success, result.SLOBreach, latency, queryLatency)
+	}
+	opts.window.record(latency)
+	opts.csv.record(pgURI, opts.TargetName, result)
+	message := ""
+	if err != nil {
+		message = dsn.RedactError(err, pgURI, opts.StandbyURI)
+	}
+	target := opts.TargetName
+	if target == "" {
+		target = dsn.Redact(pgURI)
+	}
+	opts.outcome.observe(target, result, success, message)
+	opts.matrix.record(target, success, status, latency)
+	if !success {
+		opts.failure.record(status, message, latency, result.Tags)
+	}
+
+	// A quiet run reports failures only, leaving successes to the final summary
+	if success && opts.verbosity == verbosityQuiet {
+		return success, latency
+	}
+
+	if opts.jsonLog {
+		line, _ := json.Marshal(newAttemptRecord(attemptID, pgURI, opts.TargetName, success, status, latency, queryLatency, message, result.Tags))
+		fmt.Printf("%s\n", line)
+		return success, latency
+	}
+
+	// Print the outcome in a single write so concurrent targets do not interleave
+	prefix := ""
+	if opts.TargetName != "" {
+		prefix = fmt.Sprintf("[%s] ", opts.TargetName)
+	}
+	prefix += fmt.Sprintf("[attempt %s] ", attemptID)
+	breakdown := ""
+	if opts.verbosity == verbosityVerbose {
+		breakdown = "\n" + prefix + timingBreakdown(result)
+	}
 
 	if success {
 		if queryLatency > 0 {
-			fmt.Printf("Connection test completed successfully (connection: %.3fms, query: %.3fms)\n", 
-				float64(latency.Microseconds())/1000, float64(queryLatency.Microseconds())/1000)
+			fmt.Printf("%sConnection test completed successfully (connection: %.3fms, query: %.3fms)%s\n",
+				prefix, float64(latency.Microseconds())/1000, float64(queryLatency.Microseconds())/1000, breakdown)
 		} else {
-			fmt.Printf("Connection test completed successfully (connection: %.3fms)\n", float64(latency.Microseconds())/1000)
+			fmt.Printf("%sConnection test completed successfully (connection: %.3fms)%s\n", prefix, float64(latency.Microseconds())/1000, breakdown)
 		}
+	} else if line, ok := formatFailure(opts.errorTemplate, result, success, status, target, attemptID, message); ok {
+		fmt.Printf("%s%s%s\n", prefix, line, breakdown)
+	} else if queryFailed || status == result.QueryStatus {
+		fmt.Printf("%sConnection test failed: %s after connecting (connection: %.3fms, query: %.3fms)%s\n",
+			prefix, result.QueryStatus, float64(latency.Microseconds())/1000, float64(queryLatency.Microseconds())/1000, breakdown)
 	} else {
-		fmt.Printf("Connection test failed (latency: %.3fms)\n", float64(latency.Microseconds())/1000)
+		fmt.Printf("%sConnection test failed (latency: %.3fms)%s\n", prefix, float64(latency.Microseconds())/1000, breakdown)
 	}
 
 	return success, latency
 }
 
-// parseTags parses a string in the format "k1:v1,k2:v2" into a slice of "k1:v1", "k2:v2"
-func parseTags(tagsStr string) []string {
-	if tagsStr == "" {
-		return nil
+// failureLine is the data -error-template is executed on: the attempt's result, with the
+// success and status the test query may have overridden, and where and why it failed
+type failureLine struct {
+	conntester.Result
+	Target    string
+	AttemptID string
+	// Error message with credentials redacted, empty if the failure had no error
+	Error string
+}
+
+// formatFailure executes tmpl on a failed attempt, reporting false if there is no template or
+// it fails, in which case the built-in message is printed
+func formatFailure(tmpl *template.Template, result conntester.Result, success bool, status, target, attemptID, message string) (string, bool) {
+	if tmpl == nil {
+		return "", false
+	}
+	result.Success, result.Status = success, status
+	var line strings.Builder
+	if err := tmpl.Execute(&line, failureLine{Result: result, Target: target, AttemptID: attemptID, Error: message}); err != nil {
+		log.Printf("Failed to execute -error-template: %v", err)
+		return "", false
+	}
+	return line.String(), true
+}
+
+// attemptFailure records why an attempt failed, for the -until-failure report
+type attemptFailure struct {
+	// Status tag of the failure, which names the phase that failed
+	status string
+	// Error message with credentials redacted, empty if the failure had no error
+	err     string
+	latency time.Duration
+	tags    []string
+	at      time.Time
+
+	// Guards the fields against concurrent -uri targets
+	mu sync.Mutex
+}
+
+// record stores the details of a failed attempt. It is a no-op on a nil receiver.
+func (f *attemptFailure) record(status string, err string, latency time.Duration, tags []string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status, f.err, f.latency, f.tags, f.at = status, err, latency, tags, time.Now()
+}
+
+// print writes a detailed report of the recorded failure to stdout
+func (f *attemptFailure) print(attempt int, elapsed time.Duration) {
+	fmt.Printf("First failure on attempt %d after %v:\n", attempt, elapsed.Round(time.Millisecond))
+	fmt.Printf("  time:    %s\n", f.at.Format(time.RFC3339Nano))
+	fmt.Printf("  phase:   %s\n", f.status)
+	if f.err != "" {
+		fmt.Printf("  error:   %s\n", f.err)
+	}
+	fmt.Printf("  latency: %.3fms\n", float64(f.latency.Microseconds())/1000)
+	fmt.Printf("  tags:    %s\n", strings.Join(f.tags, ","))
+}
+
+// probeTarget is one database probed each attempt, with the tags identifying it
+type probeTarget struct {
+	uri string
+	// Name printed with the target's results, empty for a single target
+	name string
+	tags []string
+	// Connection kept open across attempts, nil unless -persistent is set
+	persistent *conntester.PersistentConn
+	// Test query, connection timeout, and repeat interval of a -config target, empty or zero for the flags'
+	query    string
+	timeout  time.Duration
+	interval time.Duration
+}
+
+// timeoutOr returns the target's own timeout, or fallback if it has none
+func (t probeTarget) timeoutOr(fallback time.Duration) time.Duration {
+	if t.timeout > 0 {
+		return t.timeout
 	}
-	
-	var result []string
-	tagPairs := strings.Split(tagsStr, ",")
-	
-	for _, pair := range tagPairs {
-		pair = strings.TrimSpace(pair)
-		if pair == "" {
+	return fallback
+}
+
+// uriList collects the values of the repeatable -uri flag
+type uriList []string
+
+func (l *uriList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set adds one URI, or several separated by commas. A comma only separates URIs when the
+// next one starts with a scheme, so commas inside a URI or DSN are kept.
+func (l *uriList) Set(value string) error {
+	parts := strings.Split(value, ",")
+	uri := parts[0]
+	for _, part := range parts[1:] {
+		if _, next := splitURILabel(part); hasURIScheme(next) {
+			*l = append(*l, uri)
+			uri = part
 			continue
 		}
-		
-		// Only add pairs that have the format k:v
-		if strings.Contains(pair, ":") {
-			result = append(result, pair)
+		uri += "," + part
+	}
+	*l = append(*l, uri)
+	return nil
+}
+
+// uriVars is the -var flag: values for the {{key}} placeholders of the URIs, given as key=value
+// and repeated for each key
+type uriVars map[string]string
+
+func (v uriVars) String() string {
+	keys := make([]string, 0, len(v))
+	for key := range v {
+		keys = append(keys, key+"="+v[key])
+	}
+	slices.Sort(keys)
+	return strings.Join(keys, ",")
+}
+
+func (v uriVars) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return errors.New("expected key=value")
+	}
+	v[key] = val
+	return nil
+}
+
+// splitURILabel splits a label=URI target into its label and URI. The label must be followed
+// by a URI scheme, so keyword/value DSNs such as "host=db1 dbname=app" are not mistaken for one.
+func splitURILabel(value string) (label, uri string) {
+	label, rest, ok := strings.Cut(value, "=")
+	if !ok || label == "" || strings.ContainsAny(label, " :/@") {
+		return "", value
+	}
+	if !hasURIScheme(rest) {
+		return "", value
+	}
+	return label, rest
+}
+
+// withMySQLProgramName sets the program_name connection attribute of a go-sql-driver/mysql DSN,
+// which MySQL shows in performance_schema.session_connect_attrs, replacing any the DSN sets
+func withMySQLProgramName(mysqlDSN, name string) (string, error) {
+	if strings.ContainsAny(name, ",:") {
+		return "", errors.New("a MySQL client identifier cannot contain commas or colons")
+	}
+	cfg, err := mysql.ParseDSN(mysqlDSN)
+	if err != nil {
+		return "", err
+	}
+	attrs := []string{"program_name:" + name}
+	for _, attr := range strings.Split(cfg.ConnectionAttributes, ",") {
+		if attr != "" && !strings.HasPrefix(attr, "program_name:") {
+			attrs = append(attrs, attr)
+		}
+	}
+	cfg.ConnectionAttributes = strings.Join(attrs, ",")
+	return cfg.FormatDSN(), nil
+}
+
+// uriTags returns the host, port, and db tags of the server and database a URI or keyword DSN
+// names, leaving out any it does not set
+func uriTags(uri string) []string {
+	components, err := dsn.ParseComponents(uri)
+	if err != nil {
+		return nil
+	}
+	var tags []string
+	for _, tag := range []struct{ key, value string }{{"host", components.Host}, {"port", components.Port}, {"db", components.DBName}} {
+		if tag.value != "" {
+			tags = append(tags, tag.key+":"+tag.value)
+		}
+	}
+	return tags
+}
+
+// hasURIScheme reports whether value starts with a scheme:// prefix
+func hasURIScheme(value string) bool {
+	scheme, _, ok := strings.Cut(value, "://")
+	return ok && scheme != "" && !strings.ContainsAny(scheme, " =/@,")
+}
+
+// flushWithTimeout synchronously flushes the metrics backend, giving up after timeout
+func flushWithTimeout(client conntester.Backend, timeout time.Duration) {
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Flush()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Printf("Failed to flush metrics: %v", err)
+		}
+	case <-time.After(timeout):
+		log.Printf("Timed out flushing metrics after %v", timeout)
+	}
+}
+
+// verifyMetricsPipeline writes a uniquely tagged sentinel metric named metricName straight to the StatsD socket
+// and returns the sentinel. The StatsD client drops write errors silently, and a refused UDP
+// write only surfaces as an error on the next write, so the sentinel gauge is written twice.
+func verifyMetricsPipeline(statsdAddr, metricName string) (string, error) {
+	sentinel := fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+
+	network, address := statsdNetwork(statsdAddr)
+	conn, err := net.DialTimeout(network, address, exitFlushTimeout)
+	if err != nil {
+		return sentinel, err
+	}
+	defer conn.Close()
+
+	payload := []byte(fmt.Sprintf("%s:1|g|#sentinel:%s", metricName, sentinel))
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			time.Sleep(preflightPause)
+		}
+		conn.SetWriteDeadline(time.Now().Add(exitFlushTimeout))
+		if _, err := conn.Write(payload); err != nil {
+			return sentinel, err
+		}
+	}
+	return sentinel, nil
+}
+
+// splitStatements splits a SQL script into its statements on semicolons, dropping empty ones.
+// Semicolons inside string literals or function bodies are not recognized.
+func splitStatements(script string) []string {
+	var statements []string
+	for _, statement := range strings.Split(script, ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+// parseSQLStates parses a comma-separated list of SQLSTATE codes, normalized to upper case
+func parseSQLStates(codesStr string) []string {
+	var codes []string
+	for _, code := range strings.Split(codesStr, ",") {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if code != "" {
+			codes = append(codes, code)
 		}
 	}
-	
-	return result
+	return codes
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// matrixRow is the -matrix result of one target
+type matrixRow struct {
+	target string
+	// Set once the target's attempt is recorded
+	done    bool
+	success bool
+	status  string
+	latency time.Duration
+}
+
+// matrixTable collects the single attempt of every target for the -matrix pass/fail table
+type matrixTable struct {
+	// Guards the rows against concurrent -uri targets
+	mu   sync.Mutex
+	rows []matrixRow
+}
+
+// newMatrixTable returns a table with a row per target, printed in the order given, each named
+// as runConnectionTest reports it
+func newMatrixTable(targets []string) *matrixTable {
+	rows := make([]matrixRow, len(targets))
+	for i, target := range targets {
+		rows[i].target = target
+	}
+	return &matrixTable{rows: rows}
+}
+
+// record fills the first unrecorded row of target. It is a no-op on a nil receiver.
+func (m *matrixTable) record(target string, success bool, status string, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.rows {
+		if row := &m.rows[i]; row.target == target && !row.done {
+			row.done, row.success, row.status, row.latency = true, success, status, latency
+			return
+		}
+	}
+}
+
+// print writes the table, a line per target with its status and connection latency, followed
+// by the number of targets that passed. A target that was never attempted is listed as skipped.
+func (m *matrixTable) print() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	width := len("TARGET")
+	for _, row := range m.rows {
+		width = max(width, len(row.target))
+	}
+	passed := 0
+	fmt.Printf("%-*s  %-6s  %-24s  %s\n", width, "TARGET", "RESULT", "STATUS", "LATENCY")
+	for _, row := range m.rows {
+		switch {
+		case !row.done:
+			fmt.Printf("%-*s  %-6s  %-24s  %s\n", width, row.target, "SKIP", "-", "-")
+		case row.success:
+			passed++
+			fmt.Printf("%-*s  %-6s  %-24s  %.3fms\n", width, row.target, "PASS", row.status, float64(row.latency.Microseconds())/1000)
+		default:
+			fmt.Printf("%-*s  %-6s  %-24s  %.3fms\n", width, row.target, "FAIL", row.status, float64(row.latency.Microseconds())/1000)
+		}
+	}
+	fmt.Printf("%d of %d targets passed\n", passed, len(m.rows))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chalk/conntester"
+)
+
+// runRampDown probes with concurrency stepping down from maxConcurrency to 1, holding each level
+// for stepDuration, and prints the connection latency observed at each level. Per-attempt metrics
+// are tagged with the concurrency level. It returns false if any attempt failed.
+func runRampDown(pgURI string, timeout time.Duration, client conntester.Backend, customTags []string, opts probeOptions, maxConcurrency int, stepDuration time.Duration) bool {
+	opts = opts.withoutIterationState()
+
+	allSucceeded := true
+	for concurrency := maxConcurrency; concurrency >= 1; concurrency-- {
+		levelTags := append(customTags[:len(customTags):len(customTags)], fmt.Sprintf("concurrency:%d", concurrency))
+		tester := conntester.Tester{
+			URI:     pgURI,
+			Timeout: timeout,
+			Backend: client,
+			Tags:    levelTags,
+			Options: opts.Options,
+		}
+		deadline := time.Now().Add(stepDuration)
+
+		var mu sync.Mutex
+		var attempts, failures int
+		var total, maxLatency time.Duration
+
+		// Track how many attempts are actually in flight at once, versus the requested level
+		var inflight, inflightMax atomic.Int64
+
+		var wg sync.WaitGroup
+		for worker := 0; worker < concurrency; worker++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for time.Now().Before(deadline) {
+					storeMax(&inflightMax, inflight.Add(1))
+					result, _ := tester.Run(context.Background())
+					success, latency := result.Success, result.ConnectionLatency
+					inflight.Add(-1)
+
+					mu.Lock()
+					attempts++
+					if !success {
+						failures++
+					}
+					total += latency
+					maxLatency = max(maxLatency, latency)
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		mean := time.Duration(0)
+		if attempts > 0 {
+			mean = total / time.Duration(attempts)
+		}
+		fmt.Printf("concurrency=%d inflight_max=%d attempts=%d failures=%d mean=%.3fms max=%.3fms\n",
+			concurrency, inflightMax.Load(), attempts, failures, float64(mean.Microseconds())/1000, float64(maxLatency.Microseconds())/1000)
+		if err := client.Gauge(conntester.InflightMaxMetric, float64(inflightMax.Load()), levelTags); err != nil {
+			log.Printf("Failed to emit in-flight max metric: %v", err)
+		}
+
+		if failures > 0 {
+			allSucceeded = false
+		}
+	}
+
+	return allSucceeded
+}
+
+// storeMax raises peak to value if value is larger
+func storeMax(peak *atomic.Int64, value int64) {
+	for {
+		current := peak.Load()
+		if value <= current || peak.CompareAndSwap(current, value) {
+			return
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// runScheduledTargets probes each target on its own interval, the target's or defaultInterval,
+// measured from the start of each attempt. It runs until every target has made count attempts
+// (0 = unlimited), maxRuntime elapses (0 = unlimited), or a shutdown signal arrives, and returns
+// the attempts and failures across all targets and the signal if one ended the run.
+//
+// When reload is set, SIGHUP replaces the targets with the ones it returns: removed and changed
+// targets are stopped once any attempt in progress finishes, and added and changed ones start
+// right away, keeping the persistent connection of a changed target. If reload fails, the
+// current targets keep running.
+func runScheduledTargets(targets []probeTarget, defaultInterval time.Duration, count int, maxRuntime time.Duration, probe func(target probeTarget, attempt int) bool, reload func() ([]probeTarget, error)) (attempts, failures int, sig os.Signal) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if maxRuntime > 0 {
+		ctx, cancel = context.WithTimeout(ctx, maxRuntime)
+		defer cancel()
+	}
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(shutdown)
+
+	// A nil channel never fires, so SIGHUP keeps its default behavior without reload
+	var hup chan os.Signal
+	if reload != nil {
+		hup = make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+	}
+
+	// Only this goroutine touches running and the counts; the target goroutines report back
+	// over results and finished
+	type result struct{ success bool }
+	results := make(chan result)
+	finished := make(chan struct{})
+	running := make(map[string]*scheduledTarget)
+	active := 0
+
+	start := func(target probeTarget) {
+		interval := target.interval
+		if interval == 0 {
+			interval = defaultInterval
+		}
+		targetCtx, targetCancel := context.WithCancel(ctx)
+		scheduled := &scheduledTarget{target: target, cancel: targetCancel, done: make(chan struct{})}
+		running[target.key()] = scheduled
+		active++
+		go func() {
+			defer func() {
+				close(scheduled.done)
+				finished <- struct{}{}
+			}()
+			// Fire the first attempt right away, as in repeat mode
+			timer := time.NewTimer(0)
+			defer timer.Stop()
+			for attempt := 1; count == 0 || attempt <= count; attempt++ {
+				select {
+				case <-timer.C:
+				case <-targetCtx.Done():
+					return
+				}
+				started := time.Now()
+				results <- result{probe(target, attempt)}
+				timer.Reset(max(0, interval-time.Since(started)))
+			}
+		}()
+	}
+	for _, target := range targets {
+		start(target)
+	}
+
+	for active > 0 {
+		select {
+		case r := <-results:
+			attempts++
+			if !r.success {
+				failures++
+			}
+		case <-finished:
+			active--
+		case <-hup:
+			reloaded, err := reload()
+			if err != nil {
+				log.Printf("Failed to reload the config, keeping the current targets: %v", err)
+				continue
+			}
+			removed, changed := 0, 0
+			wanted := make(map[string]probeTarget, len(reloaded))
+			for _, target := range reloaded {
+				wanted[target.key()] = target
+			}
+			for key, scheduled := range running {
+				target, ok := wanted[key]
+				if ok && target.sameSettings(scheduled.target) {
+					delete(wanted, key)
+					continue
+				}
+				// Let the attempt in progress finish before its connection is closed or handed over
+				scheduled.cancel()
+				for waiting := true; waiting; {
+					select {
+					case r := <-results:
+						attempts++
+						if !r.success {
+							failures++
+						}
+					case <-scheduled.done:
+						waiting = false
+					}
+				}
+				delete(running, key)
+				if ok {
+					target.persistent = scheduled.target.persistent
+					wanted[key] = target
+					changed++
+				} else {
+					if scheduled.target.persistent != nil {
+						scheduled.target.persistent.Close()
+					}
+					removed++
+				}
+			}
+			for _, target := range reloaded {
+				if target, ok := wanted[target.key()]; ok {
+					if _, restarted := running[target.key()]; !restarted {
+						start(target)
+					}
+				}
+			}
+			added := len(wanted) - changed
+			log.Printf("Reloaded the config: %d targets, %d added, %d removed, %d changed", len(running), added, removed, changed)
+		case sig = <-shutdown:
+			// Let attempts in progress finish so their results are counted and flushed
+			cancel()
+			for active > 0 {
+				select {
+				case r := <-results:
+					attempts++
+					if !r.success {
+						failures++
+					}
+				case <-finished:
+					active--
+				}
+			}
+		}
+	}
+	return attempts, failures, sig
+}
+
+// scheduledTarget is a target probed by runScheduledTargets
+type scheduledTarget struct {
+	target probeTarget
+	// Stops the target's attempts once the one in progress, if any, finishes
+	cancel context.CancelFunc
+	// Closed once the target's goroutine has exited
+	done chan struct{}
+}
+
+// key identifies a target across config reloads
+func (t probeTarget) key() string {
+	return t.name + "\x00" + t.uri
+}
+
+// sameSettings reports whether t is probed the same way as other
+func (t probeTarget) sameSettings(other probeTarget) bool {
+	return t.query == other.query && t.timeout == other.timeout && t.interval == other.interval && slices.Equal(t.tags, other.tags)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log"
+
+	"github.com/chalk/conntester"
+)
+
+// attemptStreak counts the consecutive successful or failed iterations up to the latest one,
+// so alerts can threshold on a gauge instead of reconstructing runs from the attempt count
+type attemptStreak struct {
+	successes int
+	failures  int
+}
+
+// observe extends the current streak, or starts a new one on a change of outcome
+func (s *attemptStreak) observe(success bool) {
+	if success {
+		s.successes++
+		s.failures = 0
+	} else {
+		s.failures++
+		s.successes = 0
+	}
+}
+
+// emit sets both streak gauges, one of which is always zero
+func (s *attemptStreak) emit(client conntester.Backend, customTags []string) {
+	if err := client.Gauge(conntester.ConsecutiveSuccessesMetric, float64(s.successes), customTags); err != nil {
+		log.Printf("Failed to emit consecutive successes metric: %v", err)
+	}
+	if err := client.Gauge(conntester.ConsecutiveFailuresMetric, float64(s.failures), customTags); err != nil {
+		log.Printf("Failed to emit consecutive failures metric: %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// latencySummary accumulates every attempt of a repeat run for the summary printed on shutdown
+type latencySummary struct {
+	attempts  int
+	successes int
+	// Attempts slower than -max-connection-latency or -max-query-latency
+	sloBreaches int
+
+	connectionLatencies []time.Duration
+	queryLatencies      []time.Duration
+
+	// Guards the fields against concurrent -uri targets
+	mu sync.Mutex
+}
+
+// record adds an attempt. A zero query latency means the test query did not run.
+func (s *latencySummary) record(success, sloBreach bool, connectionLatency, queryLatency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if success {
+		s.successes++
+	}
+	if sloBreach {
+		s.sloBreaches++
+	}
+	s.connectionLatencies = append(s.connectionLatencies, connectionLatency)
+	if queryLatency > 0 {
+		s.queryLatencies = append(s.queryLatencies, queryLatency)
+	}
+}
+
+// print writes the attempt count, success rate, and latency distribution to stdout
+func (s *latencySummary) print() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attempts == 0 {
+		fmt.Println("Summary: no attempts completed")
+		return
+	}
+
+	fmt.Printf("Summary: %d attempts, %d succeeded (%.2f%%)\n",
+		s.attempts, s.successes, float64(s.successes)/float64(s.attempts)*100)
+	if s.sloBreaches > 0 {
+		fmt.Printf("SLO breaches: %d of %d attempts exceeded -max-connection-latency or -max-query-latency\n", s.sloBreaches, s.attempts)
+	}
+	fmt.Printf("%-12s %7s %10s %10s %10s %10s %10s %10s\n", "", "count", "min", "mean", "p50", "p95", "p99", "max")
+	printLatencyRow("connection", s.connectionLatencies)
+	printLatencyRow("query", s.queryLatencies)
+}
+
+// printLatencyRow prints one row of the summary table, in milliseconds
+func printLatencyRow(name string, latencies []time.Duration) {
+	stats := summarizeLatencies(latencies)
+	if stats.Count == 0 {
+		fmt.Printf("%-12s %7d\n", name, 0)
+		return
+	}
+
+	fmt.Printf("%-12s %7d %8.3fms %8.3fms %8.3fms %8.3fms %8.3fms %8.3fms\n", name, stats.Count,
+		stats.MinMs, stats.MeanMs, stats.P50Ms, stats.P95Ms, stats.P99Ms, stats.MaxMs)
+}
+
+// latencyStats is the distribution of one kind of latency, in milliseconds
+type latencyStats struct {
+	Count  int     `json:"count"`
+	MinMs  float64 `json:"min_ms"`
+	MeanMs float64 `json:"mean_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	P95Ms  float64 `json:"p95_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+	MaxMs  float64 `json:"max_ms"`
+}
+
+// summarizeLatencies returns the distribution of latencies, all zero if there are none
+func summarizeLatencies(latencies []time.Duration) latencyStats {
+	if len(latencies) == 0 {
+		return latencyStats{}
+	}
+
+	sorted := slices.Clone(latencies)
+	slices.Sort(sorted)
+
+	var total time.Duration
+	for _, latency := range sorted {
+		total += latency
+	}
+	mean := total / time.Duration(len(sorted))
+
+	return latencyStats{
+		Count:  len(sorted),
+		MinMs:  millis(sorted[0]),
+		MeanMs: millis(mean),
+		P50Ms:  millis(percentile(sorted, 50)),
+		P95Ms:  millis(percentile(sorted, 95)),
+		P99Ms:  millis(percentile(sorted, 99)),
+		MaxMs:  millis(sorted[len(sorted)-1]),
+	}
+}
+
+// summaryConfig is the configuration of the run recorded in the -json-summary file
+type summaryConfig struct {
+	// Target URIs with passwords redacted
+	URIs          []string `json:"uris"`
+	Driver        string   `json:"driver"`
+	Query         string   `json:"query"`
+	TimeoutMs     float64  `json:"timeout_ms"`
+	RepeatSeconds float64  `json:"repeat_seconds"`
+	Count         int      `json:"count"`
+	MaxRuntimeMs  float64  `json:"max_runtime_ms"`
+	Concurrency   int      `json:"concurrency"`
+	Tags          []string `json:"tags"`
+}
+
+// summaryReport is the document written to the -json-summary file
+type summaryReport struct {
+	Timestamp   string        `json:"timestamp"`
+	Config      summaryConfig `json:"config"`
+	Attempts    int           `json:"attempts"`
+	Successes   int           `json:"successes"`
+	Failures    int           `json:"failures"`
+	SuccessRate float64       `json:"success_rate"`
+	SLOBreaches int           `json:"slo_breaches"`
+	Connection  latencyStats  `json:"connection"`
+	Query       latencyStats  `json:"query"`
+}
+
+// summaryFile writes the summary of a run as JSON for -json-summary
+type summaryFile struct {
+	path   string
+	config summaryConfig
+}
+
+// write replaces the file with the summary, logging any error. It is a no-op on a nil receiver.
+func (f *summaryFile) write(s *latencySummary) {
+	if f == nil {
+		return
+	}
+
+	s.mu.Lock()
+	report := summaryReport{
+		Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+		Config:      f.config,
+		Attempts:    s.attempts,
+		Successes:   s.successes,
+		Failures:    s.attempts - s.successes,
+		SLOBreaches: s.sloBreaches,
+		Connection:  summarizeLatencies(s.connectionLatencies),
+		Query:       summarizeLatencies(s.queryLatencies),
+	}
+	s.mu.Unlock()
+	if report.Attempts > 0 {
+		report.SuccessRate = float64(report.Successes) / float64(report.Attempts)
+	}
+	if report.Config.Tags == nil {
+		report.Config.Tags = []string{}
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = os.WriteFile(f.path, append(data, '\n'), 0o644)
+	}
+	if err != nil {
+		log.Printf("Failed to write JSON summary to %s: %v", f.path, err)
+	}
+}
+
+// percentile returns the nearest-rank percentile p (0-100) of an ascending, non-empty slice
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(float64(len(sorted))*p/100)) - 1
+	return sorted[max(0, min(rank, len(sorted)-1))]
+}
+
+// millis returns a duration in milliseconds with microsecond precision
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/chalk/conntester"
+)
+
+// tagDrops is the -drop-tags flag: tag keys to leave off each named metric, as
+// metric=key,key entries separated by semicolons or given in separate flags
+type tagDrops map[string][]string
+
+func (d tagDrops) String() string {
+	entries := make([]string, 0, len(d))
+	for name, keys := range d {
+		entries = append(entries, strings.TrimPrefix(name, conntester.MetricStem+".")+"="+strings.Join(keys, ","))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ";")
+}
+
+// Set adds entries to the flag. A metric may be named in full or by the part after
+// chalk.conntester., e.g. attempt_count.
+func (d tagDrops) Set(value string) error {
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		name, keys, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return fmt.Errorf("%q is not in the form metric=key,key", entry)
+		}
+		if !strings.HasPrefix(name, conntester.MetricStem+".") {
+			name = conntester.MetricStem + "." + name
+		}
+		for _, key := range strings.Split(keys, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				d[name] = append(d[name], key)
+			}
+		}
+		if len(d[name]) == 0 {
+			return fmt.Errorf("%q names no tag keys", entry)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+// newStatsdClient creates a StatsD client for a host:port UDP address or a unix:// socket path.
+// Over a Unix socket the agent's receive buffer filling up is an error rather than silent loss,
+// so those send errors are logged instead of only being counted by the client.
+func newStatsdClient(addr string, options ...statsd.Option) (*statsd.Client, error) {
+	network, address := statsdNetwork(addr)
+	if network == "udp" {
+		return statsd.New(addr, options...)
+	}
+	return statsd.NewWithWriter(&udsWriter{path: address}, options...)
+}
+
+// addrList is the -statsd flag: one or more addresses, given repeatedly or separated by commas.
+// The first address given replaces the default.
+type addrList struct {
+	addrs []string
+	set   bool
+}
+
+func (l *addrList) String() string {
+	return strings.Join(l.addrs, ",")
+}
+
+func (l *addrList) Set(value string) error {
+	if !l.set {
+		l.addrs, l.set = nil, true
+	}
+	for _, addr := range strings.Split(value, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			return errors.New("empty address")
+		}
+		l.addrs = append(l.addrs, addr)
+	}
+	return nil
+}
+
+// statsdNetwork returns the network and address to dial for a -statsd address
+func statsdNetwork(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, statsd.UnixAddressPrefix); ok {
+		return "unixgram", path
+	}
+	return "udp", addr
+}
+
+// udsWriter sends StatsD payloads over a Unix datagram socket, logging failed writes.
+// The socket is dialed on first use and redialed after an error, so an agent restart
+// only loses the payloads sent while it was down.
+type udsWriter struct {
+	path string
+
+	mu           sync.Mutex
+	conn         net.Conn
+	writeTimeout time.Duration
+}
+
+func (w *udsWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.conn == nil {
+		conn, err := net.Dial("unixgram", w.path)
+		if err != nil {
+			log.Printf("Failed to send metrics to %s: %v", w.path, err)
+			return 0, err
+		}
+		w.conn = conn
+	}
+
+	if w.writeTimeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(w.writeTimeout))
+	}
+	n, err := w.conn.Write(data)
+	if err != nil {
+		log.Printf("Failed to send metrics to %s: %v", w.path, err)
+		w.conn.Close()
+		w.conn = nil
+	}
+	return n, err
+}
+
+func (w *udsWriter) SetWriteTimeout(d time.Duration) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writeTimeout = d
+	return nil
+}
+
+func (w *udsWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	return w.conn.Close()
+}
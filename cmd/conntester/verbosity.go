@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/chalk/conntester"
+	"github.com/chalk/conntester/internal/dsn"
+)
+
+// verbosity is how much is printed about each attempt, set with -v or -quiet
+type verbosity int
+
+const (
+	// One line per attempt
+	verbosityNormal verbosity = iota
+	// Failed attempts only, plus the final summary
+	verbosityQuiet
+	// The resolved configuration at startup, and a timing breakdown of each attempt
+	verbosityVerbose
+)
+
+// printConfiguration prints what each target resolves to and the probe settings, for -v
+func printConfiguration(targets []probeTarget, timeout time.Duration, customTags []string, opts probeOptions) {
+	for _, target := range targets {
+		name := target.name
+		if name == "" {
+			name = dsn.Redact(target.uri)
+		}
+		components, err := dsn.ParseComponents(target.uri)
+		if err != nil {
+			fmt.Printf("Target %s: %v\n", name, err)
+			continue
+		}
+		fmt.Printf("Target %s: host %s, port %s, database %s, user %s, timeout %v\n",
+			name, components.Host, components.Port, components.DBName, components.User, target.timeoutOr(timeout))
+	}
+
+	query := opts.Query
+	if query == "" {
+		query = conntester.DefaultQuery
+	}
+	switch {
+	case opts.SkipQuery:
+		fmt.Println("Test query: none")
+	case len(opts.Script) > 0:
+		fmt.Printf("Test query: %d statement script\n", len(opts.Script))
+	default:
+		fmt.Printf("Test query: %q\n", query)
+	}
+	if opts.QueryTimeout > 0 {
+		fmt.Printf("Query timeout: %v\n", opts.QueryTimeout)
+	}
+	fmt.Printf("Tags: %s\n", strings.Join(customTags, ","))
+}
+
+// timingBreakdown describes where the time of an attempt went, for -v. Phases that were not
+// measured, such as the TLS handshake of a plaintext connection, are left out.
+func timingBreakdown(result conntester.Result) string {
+	phases := []string{}
+	for _, phase := range []struct {
+		name    string
+		latency time.Duration
+	}{
+		{"tcp", result.TCPLatency},
+		{"tls", result.TLSLatency},
+		{"connection", result.ConnectionLatency},
+		{"query", result.QueryLatency},
+	} {
+		if phase.latency > 0 {
+			phases = append(phases, fmt.Sprintf("%s %.3fms", phase.name, float64(phase.latency.Microseconds())/1000))
+		}
+	}
+	return "Timing: " + strings.Join(phases, ", ")
+}
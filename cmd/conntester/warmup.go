@@ -0,0 +1,32 @@
+package main
+
+import (
+	"time"
+)
+
+// discardBackend drops every metric, for -warmup attempts
+type discardBackend struct{}
+
+func (discardBackend) RecordLatency(name string, latency time.Duration, tags []string) error {
+	return nil
+}
+
+func (discardBackend) Count(name string, value int64, tags []string) error {
+	return nil
+}
+
+func (discardBackend) Gauge(name string, value float64, tags []string) error {
+	return nil
+}
+
+func (discardBackend) RecoveryEvent(title, text string, tags []string) error {
+	return nil
+}
+
+func (discardBackend) Flush() error {
+	return nil
+}
+
+func (discardBackend) Close() error {
+	return nil
+}
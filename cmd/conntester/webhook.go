@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// webhookPayload is the data posted to the webhook, and the data available to --webhook-template
+type webhookPayload struct {
+	Target    string  `json:"target"`
+	Reason    string  `json:"reason"`
+	LatencyMs float64 `json:"latency_ms"`
+	Timestamp string  `json:"timestamp"`
+}
+
+// webhookNotifier posts to a webhook when the probe state changes between up and down
+type webhookNotifier struct {
+	url    string
+	target string
+	// Optional template rendering the request body, JSON-encoded payload when nil
+	tmpl *template.Template
+	// Minimum time between notifications so a flapping target does not spam
+	debounce time.Duration
+	client   *http.Client
+
+	notifiedDown bool
+	notified     bool
+	lastSent     time.Time
+}
+
+func newWebhookNotifier(url, target, bodyTemplate string, debounce time.Duration) (*webhookNotifier, error) {
+	notifier := &webhookNotifier{
+		url:      url,
+		target:   target,
+		debounce: debounce,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+
+	if bodyTemplate != "" {
+		tmpl, err := template.New("webhook").Option("missingkey=error").Parse(bodyTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook template: %w", err)
+		}
+		notifier.tmpl = tmpl
+	}
+
+	return notifier, nil
+}
+
+// observe notifies on the first failure and on recovery, at most once per debounce interval.
+// Once the interval has passed, the current state is sent if it differs from the last one sent.
+func (w *webhookNotifier) observe(success bool, latency time.Duration) {
+	down := !success
+	if w.notified && down == w.notifiedDown {
+		return
+	}
+	// Nothing to report until the first failure
+	if !w.notified && !down {
+		return
+	}
+	if !w.lastSent.IsZero() && time.Since(w.lastSent) < w.debounce {
+		return
+	}
+
+	reason := "connection_failed"
+	if !down {
+		reason = "recovered"
+	}
+	payload := webhookPayload{
+		Target:    w.target,
+		Reason:    reason,
+		LatencyMs: float64(latency.Microseconds()) / 1000,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if err := w.send(payload); err != nil {
+		log.Printf("Failed to send webhook notification: %v", err)
+		return
+	}
+	w.notified = true
+	w.notifiedDown = down
+	w.lastSent = time.Now()
+}
+
+// send renders and posts a single notification
+func (w *webhookNotifier) send(payload webhookPayload) error {
+	var body bytes.Buffer
+	if w.tmpl != nil {
+		if err := w.tmpl.Execute(&body, payload); err != nil {
+			return fmt.Errorf("failed to render webhook template: %w", err)
+		}
+	} else if err := json.NewEncoder(&body).Encode(payload); err != nil {
+		return err
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chalk/conntester"
+)
+
+// windowSize is the -window flag: a number of attempts, or a duration such as 5m
+type windowSize struct {
+	// Attempts kept, 0 when the window is bounded by age
+	count int
+	// Age of the oldest attempt kept, 0 when the window is bounded by count
+	age time.Duration
+}
+
+func (w *windowSize) String() string {
+	if w.age > 0 {
+		return w.age.String()
+	}
+	return strconv.Itoa(w.count)
+}
+
+func (w *windowSize) Set(value string) error {
+	if count, err := strconv.Atoi(value); err == nil {
+		if count < 0 {
+			return errors.New("must not be negative")
+		}
+		*w = windowSize{count: count}
+		return nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil {
+		return errors.New("expected a number of attempts such as 100, or a duration such as 5m")
+	}
+	if age < 0 {
+		return errors.New("must not be negative")
+	}
+	*w = windowSize{age: age}
+	return nil
+}
+
+// enabled reports whether a window was configured
+func (w windowSize) enabled() bool {
+	return w.count > 0 || w.age > 0
+}
+
+// windowSample is the connection latency of one attempt in the window
+type windowSample struct {
+	at      time.Time
+	latency time.Duration
+}
+
+// rollingWindow keeps the connection latencies of recent attempts for the -window gauges,
+// bounded like the summary's latencies but by count or age
+type rollingWindow struct {
+	size    windowSize
+	samples []windowSample
+
+	// Guards the samples against concurrent -uri targets
+	mu sync.Mutex
+}
+
+// record adds an attempt and drops those that fell out of the window. It is a no-op on a nil receiver.
+func (w *rollingWindow) record(latency time.Duration) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples = append(w.samples, windowSample{at: time.Now(), latency: latency})
+	w.trim()
+}
+
+// trim drops the samples outside the window, oldest first
+func (w *rollingWindow) trim() {
+	drop := 0
+	if w.size.count > 0 {
+		drop = max(0, len(w.samples)-w.size.count)
+	} else {
+		cutoff := time.Now().Add(-w.size.age)
+		for drop < len(w.samples) && w.samples[drop].at.Before(cutoff) {
+			drop++
+		}
+	}
+	w.samples = slices.Delete(w.samples, 0, drop)
+}
+
+// emit sets the window gauges, in seconds, from the attempts currently in the window, and
+// nothing when it is empty. It is a no-op on a nil receiver.
+func (w *rollingWindow) emit(client conntester.Backend, customTags []string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.trim()
+	latencies := make([]time.Duration, len(w.samples))
+	for i, sample := range w.samples {
+		latencies[i] = sample.latency
+	}
+	w.mu.Unlock()
+	if len(latencies) == 0 {
+		return
+	}
+
+	// Same figures as the summary's, without rounding to microseconds
+	slices.Sort(latencies)
+	var total time.Duration
+	for _, latency := range latencies {
+		total += latency
+	}
+	for _, gauge := range []struct {
+		metric  string
+		latency time.Duration
+	}{
+		{conntester.WindowMinMetric, latencies[0]},
+		{conntester.WindowAvgMetric, total / time.Duration(len(latencies))},
+		{conntester.WindowMaxMetric, latencies[len(latencies)-1]},
+		{conntester.WindowP95Metric, percentile(latencies, 95)},
+	} {
+		if err := client.Gauge(gauge.metric, gauge.latency.Seconds(), customTags); err != nil {
+			log.Printf("Failed to emit %s metric: %v", gauge.metric, err)
+		}
+	}
+}
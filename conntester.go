@@ -0,0 +1,1250 @@
+// Package conntester probes database connectivity and reports connection and test query
+// latency to StatsD or Prometheus. The conntester command in cmd/conntester is built on it.
+package conntester
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chalk/conntester/internal/dsn"
+	"github.com/lib/pq"
+)
+
+// Metric names. Use NewRenamedBackend to emit them under another stem or namespace.
+const (
+	// Stem every metric name starts with
+	MetricStem = "chalk.conntester"
+
+	AttemptCountMetric         = MetricStem + ".attempt_count"
+	ConnectionLatencyMetric    = MetricStem + ".duration"
+	DNSLatencyMetric           = MetricStem + ".dns_duration"
+	TCPLatencyMetric           = MetricStem + ".tcp_duration"
+	TLSLatencyMetric           = MetricStem + ".tls_duration"
+	QueryLatencyMetric         = MetricStem + ".test_query_duration"
+	QueryTTFBMetric            = MetricStem + ".query_ttfb"
+	EmitErrorsMetric           = MetricStem + ".emit_errors"
+	HealthScoreMetric          = MetricStem + ".health_score"
+	HoldDurationMetric         = MetricStem + ".hold_duration"
+	TransferLatencyMetric      = MetricStem + ".transfer_duration"
+	TransferRateMetric         = MetricStem + ".transfer_throughput"
+	OutageDurationMetric       = MetricStem + ".outage_duration"
+	AttemptDurationMetric      = MetricStem + ".attempt_duration"
+	DistinctBackendsMetric     = MetricStem + ".distinct_backends"
+	SequenceMetric             = MetricStem + ".sequence"
+	LocalPortMetric            = MetricStem + ".local_port"
+	InflightMaxMetric          = MetricStem + ".inflight_max"
+	ServerConnsMetric          = MetricStem + ".server_connections"
+	PreflightMetric            = MetricStem + ".preflight"
+	ReconnectMetric            = MetricStem + ".reconnect"
+	RoleCheckLatencyMetric     = MetricStem + ".role_check_duration"
+	VersionCheckLatencyMetric  = MetricStem + ".version_check_duration"
+	RetriesMetric              = MetricStem + ".retries"
+	ConsecutiveSuccessesMetric = MetricStem + ".consecutive_successes"
+	ConsecutiveFailuresMetric  = MetricStem + ".consecutive_failures"
+	ClockSkewMetric            = MetricStem + ".clock_skew_seconds"
+	CertDaysRemainingMetric    = MetricStem + ".cert_days_remaining"
+	IdleSurvivedMetric         = MetricStem + ".idle_survived"
+	IdleFailureAgeMetric       = MetricStem + ".idle_failure_age"
+	HeartbeatMetric            = MetricStem + ".heartbeat"
+	LoopExitMetric             = MetricStem + ".loop_exit"
+	IntervalJitterMetric       = MetricStem + ".interval_jitter_ms"
+	PlanChangeMetric           = MetricStem + ".plan_change"
+	ResultChangeMetric         = MetricStem + ".result_change"
+	ColdWarmDeltaMetric        = MetricStem + ".cold_warm_delta"
+	TxLatencyMetric            = MetricStem + ".tx_duration"
+	RowCountMetric             = MetricStem + ".row_count"
+	WindowMinMetric            = MetricStem + ".window_min"
+	WindowAvgMetric            = MetricStem + ".window_avg"
+	WindowMaxMetric            = MetricStem + ".window_max"
+	WindowP95Metric            = MetricStem + ".window_p95"
+
+	// Connection pool statistics of the persistent connection's *sql.DB
+	PoolOpenConnsMetric     = MetricStem + ".pool.open_connections"
+	PoolInUseMetric         = MetricStem + ".pool.in_use"
+	PoolIdleMetric          = MetricStem + ".pool.idle"
+	PoolWaitCountMetric     = MetricStem + ".pool.wait_count"
+	PoolWaitDurationMetric  = MetricStem + ".pool.wait_duration"
+	PoolMaxIdleClosedMetric = MetricStem + ".pool.max_idle_closed"
+	// Connections the pool closed since the last attempt for exceeding SetConnMaxIdleTime and
+	// SetConnMaxLifetime
+	PoolMaxIdleTimeClosedMetric = MetricStem + ".pool.max_idle_time_closed"
+	PoolMaxLifetimeClosedMetric = MetricStem + ".pool.max_lifetime_closed"
+)
+
+const (
+	// database/sql driver used when Options.Driver is empty
+	DefaultDriver = "postgres"
+
+	// Test query run when Options.Query is empty
+	DefaultQuery = "SELECT 1"
+)
+
+var (
+	// ErrNotPrimary is returned when Options.RequirePrimary is set and the server is a replica
+	ErrNotPrimary = errors.New("connected server is a replica in recovery, but a primary is required")
+	// ErrInsufficientNodes is returned when fewer than Options.MinNodes cluster nodes are healthy
+	ErrInsufficientNodes = errors.New("fewer healthy cluster nodes than required")
+	// ErrCertExpiring is returned when the server certificate expires within Options.CertWarnDays
+	ErrCertExpiring = errors.New("server certificate expires within the warning threshold")
+	// ErrEmptyResult is returned when Options.FailIfEmpty is set and the test query returned no rows
+	ErrEmptyResult = errors.New("test query returned no rows")
+)
+
+// Tester probes one database. Options may be shared between Testers, which then share
+// the cross-attempt trackers they point to.
+type Tester struct {
+	// Connection URI or DSN for the selected driver
+	URI string
+	// Deadline for connecting, and for the test query unless Options.QueryTimeout is set
+	Timeout time.Duration
+	// Backend the attempt's metrics are emitted to
+	Backend Backend
+	// Tags added to every metric
+	Tags []string
+	// Optional probe behaviors; the zero value connects and runs DefaultQuery
+	Options Options
+	// ID prefixed to the attempt's log lines so they can be matched with its result, empty for none
+	AttemptID string
+}
+
+// Options carries the optional probe behaviors
+type Options struct {
+	// Name of the target, used in recovery event titles, empty if unset
+	TargetName string
+	// database/sql driver name used to open connections, DefaultDriver if empty
+	Driver string
+	// Name the server certificate is verified against instead of the URI host, empty to use the host
+	TLSServerName string
+	// Log and count the local address of each connection
+	TrackLocalPort bool
+	// Local IP address TCP connections are made from, e.g. to pick the interface of a
+	// multi-homed host, empty to let the OS choose. PostgreSQL only.
+	SourceAddr string
+	// SOCKS5 proxy URL, e.g. socks5://bastion:1080, TCP connections are made through, empty to
+	// connect directly. The proxy resolves the host, so the separate DNS lookup is skipped.
+	// PostgreSQL only.
+	Proxy string
+	// Standby URI to fail over to when the primary cannot be reached, empty to disable
+	StandbyURI string
+	// Servers tried in order, as host or host:port, when the URI's server cannot be reached,
+	// within the same attempt and with the URI's other parameters. The attempt is tagged
+	// failover_index with the position of the server that connected, 0 for the URI's and none
+	// when all fail, and host with that server. Empty to disable.
+	FailoverHosts []string
+	// Fail attempts connected to a replica instead of a writable primary
+	RequirePrimary bool
+	// Tag the attempt role:primary or role:replica from pg_is_in_recovery(). PostgreSQL only.
+	DetectRole bool
+	// Tag the attempt pg_version:<major> from SHOW server_version. PostgreSQL only.
+	DetectVersion bool
+	// Log the server process ID of each new connection, from pg_backend_pid(), to find the
+	// connection in the server logs. PostgreSQL only.
+	LogBackendPID bool
+	// Log the first column of the test query's result, as Expect compares it
+	LogQueryResult bool
+	// Emit the days until the server's TLS certificate expires, from a separate TLS handshake
+	// with the server. PostgreSQL only.
+	CheckCert bool
+	// Fail attempts with status:cert_expiring when CheckCert finds the certificate expires in
+	// fewer than this many days, 0 to only report the expiry
+	CertWarnDays int
+	// Emit the offset of the server's clock from the local clock, from SELECT now(). PostgreSQL only.
+	DetectSkew bool
+	// Times a failed connection is retried within the attempt before it fails, 0 to fail at once.
+	// Retries share the attempt's timeout, and the connection latency includes them.
+	Retries int
+	// Wait between connection retries
+	RetryDelay time.Duration
+	// Test query run after connecting, DefaultQuery if empty
+	Query string
+	// Statements run in order on one connection instead of Query, e.g. a BEGIN ... COMMIT
+	// transaction, and timed together as the test query. Empty to run Query.
+	Script []string
+	// Run the test query inside a transaction opened with BeginTx and committed, to exercise the
+	// transaction machinery a plain query skips. Each phase is emitted as TxLatencyMetric tagged
+	// tx_phase:begin, query, or commit, and a failed phase is rolled back and tagged
+	// status:tx_failure. Ignored when Script is set.
+	TxProbe bool
+	// Run the test query in a read-only transaction that is rolled back afterward, so it cannot
+	// write. A Script's transactions are made read-only through the session instead, which is
+	// PostgreSQL only. An attempted write fails the query with status:query_failure.
+	ReadOnly bool
+	// Run the test query in a transaction that is rolled back afterward, so a write path can be
+	// probed without leaving data behind. The query's latency covers the BEGIN and ROLLBACK, and a
+	// failed rollback fails the query. Ignored when Script or TxProbe is set.
+	Rollback bool
+	// Deadline for the test query, independent of the connection timeout. Tester.Timeout if zero.
+	QueryTimeout time.Duration
+	// Skip the test query on this attempt
+	SkipQuery bool
+	// SQLSTATE codes whose errors are treated as success
+	SuccessSQLStates []string
+	// Minimum number of healthy cluster nodes, 0 to skip the check
+	MinNodes int
+	// Per-row deadline when streaming the test query result, 0 to use a single-row scan
+	RowTimeout time.Duration
+	// Size in bytes of the result fetched to measure transfer time, 0 to skip
+	PayloadSize int
+	// Connection latency above which a successful connection's ConnectionLatencyMetric is tagged
+	// status:slo_breach and Result.SLOBreach is set, 0 to disable
+	MaxConnectionLatency time.Duration
+	// Test query latency above which a successful query is given status:slo_breach, 0 to disable
+	MaxQueryLatency time.Duration
+	// Attempt duration above which the attempt is tagged as an outlier, 0 to disable
+	OutlierThreshold time.Duration
+	// How long to keep the connection open after a successful query, 0 to close immediately
+	Hold time.Duration
+	// Interval between pings while holding the connection, one second if zero
+	HoldInterval time.Duration
+	// Emit the server's open connection count
+	MeasureLoad bool
+	// Emit the target database's pool and stats gauges from the PgBouncer admin console, the
+	// pgbouncer database reached with the same URI. PostgreSQL only.
+	PgBouncer bool
+	// Fail the test query with status:unexpected_rows if it returns more than one row
+	ExpectSingleRow bool
+	// Fail the attempt with status:empty_result if the test query returns no rows. Only the
+	// first row is read, and the rest of the result is cancelled.
+	FailIfEmpty bool
+	// Fail the test query with status:row_count_failure unless it returns a number of rows within
+	// these bounds, and emit the count as RowCountMetric. Counting stops at RowBounds.Max plus
+	// one, or at RowBounds.Min without a maximum, so a large result is not read in full. Nil to
+	// skip. Not checked with RowTimeout.
+	RowCount *RowBounds
+	// Value the first column of the test query must equal, as a string, failing the query with
+	// status:assertion_failure otherwise, or compare to when prefixed with >, <, >=, <=, or !=,
+	// or regular expression it must match when prefixed with ~, e.g. "<100" or "~^ok". Empty to
+	// skip the check. Not checked with RowTimeout or ExpectSingleRow, which do not scan the result.
+	Expect string
+	// Emit Sequence as a gauge
+	EmitSequence bool
+	// Tag the attempt's metrics with its start time as TimestampTag, so a backend aggregating
+	// samples does not collapse distinct attempts
+	TimestampMetrics bool
+	// Sequence number of this attempt, starting at 1
+	Sequence int
+	// Health score state carried across attempts, nil when disabled
+	Health *HealthTracker
+	// Failure streak state used to report recoveries, nil when disabled
+	Outages *OutageTracker
+	// Distinct servers reached across attempts, nil when disabled. Not safe for concurrent use.
+	Backends *BackendTracker
+	// Hash of the test query's plan, explained before every attempt's query and compared with
+	// the baseline, nil when disabled. Postgres only.
+	Plans *ChangeTracker
+	// Hash of the test query's result, compared with the previous attempt's, nil when disabled.
+	// The whole result is read to hash it.
+	ResultHashes *ChangeTracker
+	// Most bytes of column data to read from the test query's result before cancelling it with
+	// query status result_too_large, 0 for no limit. Applies to the rows read with RowTimeout,
+	// RowCount, ExpectSingleRow, FailIfEmpty, or ResultHashes, not to the first-column scan.
+	MaxResultBytes int
+	// Connection reused across attempts, nil to open a new connection on every attempt.
+	// The standby is always connected anew. Not safe for concurrent use.
+	Persistent *PersistentConn
+	// File holding the password, re-read when the Persistent connection fails to authenticate
+	// so a rotated password is picked up without a restart. The attempt that reconnects with
+	// the new password is tagged status:auth_refresh.
+	CredentialFile string
+	// Close the Persistent connection after a failed attempt or test query, so the next attempt
+	// starts on a new one instead of a connection the failure may have left unusable. Every
+	// attempt is tagged reconnected:true or reconnected:false.
+	ReconnectOnError bool
+}
+
+// withDefaults returns a copy of the options with unset values filled in
+func (o Options) withDefaults(timeout time.Duration) Options {
+	if o.Driver == "" {
+		o.Driver = DefaultDriver
+	}
+	if o.Query == "" {
+		o.Query = DefaultQuery
+	}
+	if o.QueryTimeout == 0 {
+		o.QueryTimeout = timeout
+	}
+	if o.HoldInterval == 0 {
+		o.HoldInterval = time.Second
+	}
+	return o
+}
+
+// Result is the outcome of one connection attempt
+type Result struct {
+	Success bool
+	// Status tag of the attempt, e.g. success, failure, not_primary, insufficient_nodes, cert_expiring,
+	// empty_result, or hold_failure
+	Status            string
+	ConnectionLatency time.Duration
+	// Test query latency, zero if the query did not run
+	QueryLatency time.Duration
+	// Status tag of the test query, e.g. success, slo_breach, query_failure, or assertion_failure, empty if
+	// the query did not run
+	QueryStatus string
+	// Category of a failed connection, as tagged failure_reason, empty if the connection did
+	// not fail or the failure has no category
+	FailureReason string
+	// The connection or test query succeeded but was slower than Options.MaxConnectionLatency or
+	// Options.MaxQueryLatency
+	SLOBreach bool
+	// TCP connect and TLS handshake times of the connection, zero if not measured
+	TCPLatency time.Duration
+	TLSLatency time.Duration
+	// Tags the attempt was reported with, including any added during the attempt
+	Tags []string
+}
+
+// Run makes one connection attempt and emits its metrics. The returned error is the cause
+// of a failed attempt, and is nil when the attempt succeeded.
+func (t *Tester) Run(ctx context.Context) (Result, error) {
+	result, err := t.probe(ctx)
+
+	opts := t.Options
+	if opts.Persistent != nil && opts.ReconnectOnError && (!result.Success || queryFailed(result.QueryStatus)) {
+		t.logf("Closing the persistent connection after the failure, the next attempt reconnects")
+		opts.Persistent.Close()
+		opts.Persistent.reconnected = true
+	}
+	if opts.EmitSequence {
+		if err := t.Backend.Gauge(SequenceMetric, float64(opts.Sequence), t.Tags); err != nil {
+			t.logf("Failed to emit sequence metric: %v", err)
+		}
+	}
+	if opts.Health != nil {
+		opts.Health.emit(t.Backend, result.Success, result.ConnectionLatency, t.Tags)
+	}
+	if opts.Outages != nil {
+		if outage, recovered := opts.Outages.observe(result.Success, time.Now()); recovered {
+			reportRecovery(t.Backend, outage, t.Tags, opts.TargetName)
+		}
+	}
+
+	return result, err
+}
+
+// logf logs a line of the attempt, prefixed with its AttemptID if set
+func (t *Tester) logf(format string, args ...any) {
+	if t.AttemptID != "" {
+		format = "[attempt " + t.AttemptID + "] " + format
+	}
+	log.Printf(format, args...)
+}
+
+// probe runs the connection attempt and emits its per-attempt metrics
+func (t *Tester) probe(parent context.Context) (Result, error) {
+	pgURI, client, customTags := t.URI, t.Backend, t.Tags
+	opts := t.Options.withDefaults(t.Timeout)
+
+	// Create a context with timeout
+	ctx, cancel := context.WithTimeout(parent, t.Timeout)
+	defer cancel()
+
+	if opts.TimestampMetrics {
+		customTags = append(customTags[:len(customTags):len(customTags)], TimestampTag+":"+strconv.FormatInt(time.Now().UnixMicro(), 10))
+	}
+
+	// Count metric emission failures so they are reported once per attempt
+	emitErrors := 0
+	defer func() {
+		reportEmitErrors(client, emitErrors, customTags)
+	}()
+
+	// A reused persistent connection needs no lookup
+	persistent := opts.Persistent
+	reusing := persistent != nil && persistent.conn != nil
+	if persistent != nil && persistent.uri != "" {
+		pgURI = persistent.uri
+	}
+	if persistent != nil && opts.ReconnectOnError {
+		customTags = append(customTags[:len(customTags):len(customTags)], "reconnected:"+strconv.FormatBool(persistent.reconnected))
+		persistent.reconnected = false
+	}
+
+	// Resolve the host separately so DNS problems can be told apart from database problems
+	if opts.Driver == DefaultDriver && !reusing && opts.Proxy == "" {
+		dnsLatency, resolved, dnsErr := resolveHost(ctx, pgURI)
+		if resolved {
+			dnsStatus := "success"
+			if dnsErr != nil {
+				t.logf("Failed to resolve database host: %v", dnsErr)
+				dnsStatus = "dns_failure"
+			}
+			if err := client.RecordLatency(DNSLatencyMetric, dnsLatency, statusTags(customTags, dnsStatus)); err != nil {
+				t.logf("Failed to emit DNS latency metric: %v", err)
+				emitErrors++
+			}
+		}
+
+		// Skip the connection, unless a standby or failover server may still be reachable
+		if dnsErr != nil && opts.StandbyURI == "" && len(opts.FailoverHosts) == 0 {
+			dnsTags := statusTags(customTags, "dns_failure", "failure_reason:dns")
+			if err := client.Count(AttemptCountMetric, 1, dnsTags); err != nil {
+				t.logf("Failed to emit failure metric: %v", err)
+				emitErrors++
+			}
+			return Result{Status: "dns_failure", ConnectionLatency: dnsLatency, FailureReason: "dns", Tags: customTags}, dnsErr
+		}
+	}
+
+	// Record start time
+	startTime := time.Now()
+
+	// Open connection
+	// Capture the local address each connection is made from, for NAT and conntrack debugging
+	var onConnect func(net.Conn)
+	var localAddrMu sync.Mutex
+	var localAddr net.Addr
+	if opts.TrackLocalPort {
+		onConnect = func(conn net.Conn) {
+			localAddrMu.Lock()
+			defer localAddrMu.Unlock()
+			localAddr = conn.LocalAddr()
+		}
+	}
+
+	// Split the connect phase into TCP connect and TLS handshake
+	var trace *dialTrace
+	if opts.Driver == DefaultDriver && !reusing {
+		trace = &dialTrace{}
+	}
+
+	// Ping the persistent connection, reconnecting if the server or a proxy has dropped it
+	var db querier
+	var err error
+	warm := false
+	if reusing {
+		if pingErr := persistent.conn.PingContext(ctx); pingErr == nil {
+			db, warm = persistent.conn, true
+		} else {
+			t.logf("Persistent connection was lost, reconnecting: %s", dsn.RedactError(pingErr, pgURI))
+			persistent.Close()
+			if opts.Driver == DefaultDriver {
+				trace = &dialTrace{}
+			}
+			if err := client.Count(ReconnectMetric, 1, customTags); err != nil {
+				t.logf("Failed to emit reconnect metric: %v", err)
+				emitErrors++
+			}
+		}
+	}
+
+	var pool *sql.DB
+	if db == nil {
+		pool, err = openDB(opts.Driver, pgURI, opts.TLSServerName, onConnect, trace, opts.SourceAddr, opts.Proxy)
+	}
+	if err != nil {
+		t.logf("Failed to create database connection: %s", dsn.RedactError(err, pgURI))
+
+		// Emit metric with status:failure
+		reason := failureReason(ctx, err)
+		tags := statusTags(customTags, "failure", "failure_reason:"+reason)
+
+		if emitErr := client.Count(AttemptCountMetric, 1, tags); emitErr != nil {
+			t.logf("Failed to emit failure metric: %v", emitErr)
+			emitErrors++
+		}
+		return Result{Status: "failure", ConnectionLatency: time.Since(startTime), FailureReason: reason, Tags: customTags}, err
+	}
+
+	// Ping to verify connection is successful and calculate connection time. A reused
+	// persistent connection was pinged above; a new one is pinned for later attempts.
+	if pool != nil && persistent == nil {
+		defer pool.Close()
+		db = pool
+		err = db.PingContext(ctx)
+	} else if pool != nil {
+		var conn *sql.Conn
+		if conn, err = persistent.pin(ctx, pool); err == nil {
+			db = conn
+			err = db.PingContext(ctx)
+		}
+	}
+
+	// Retry a failed connection within the attempt, so a single lost packet does not fail it
+	retries := 0
+	for pool != nil && err != nil && retries < opts.Retries && sleepContext(ctx, opts.RetryDelay) {
+		retries++
+		t.logf("Connection failed, retrying (%d of %d): %s", retries, opts.Retries, dsn.RedactError(err, pgURI))
+		if persistent == nil {
+			err = pool.PingContext(ctx)
+			continue
+		}
+
+		// The pinned connection is broken, or was never taken, so pin a new one
+		persistent.Close()
+		if pool, err = openDB(opts.Driver, pgURI, opts.TLSServerName, onConnect, nil, opts.SourceAddr, opts.Proxy); err == nil {
+			var conn *sql.Conn
+			if conn, err = persistent.pin(ctx, pool); err == nil {
+				db = conn
+				err = db.PingContext(ctx)
+			}
+		}
+	}
+
+	// The password may have been rotated, so re-read it and reconnect once with the new one
+	authRefreshed := false
+	if err != nil && persistent != nil && opts.CredentialFile != "" && failureReason(ctx, err) == "auth" {
+		refreshedURI, readErr := ReadCredentialFile(t.URI, opts.CredentialFile)
+		if readErr != nil {
+			t.logf("Failed to re-read credential file: %v", readErr)
+		} else {
+			t.logf("Authentication failed, reconnecting with the password from %s", opts.CredentialFile)
+			pgURI, persistent.uri, authRefreshed = refreshedURI, refreshedURI, true
+			persistent.Close()
+			if pool, err = openDB(opts.Driver, pgURI, opts.TLSServerName, onConnect, nil, opts.SourceAddr, opts.Proxy); err == nil {
+				var conn *sql.Conn
+				if conn, err = persistent.pin(ctx, pool); err == nil {
+					db = conn
+					err = db.PingContext(ctx)
+				}
+			}
+		}
+	}
+
+	// Server the attempt ended up connected to, for checks that make their own connection
+	connectedURI, connectedServerName := pgURI, opts.TLSServerName
+
+	// Fail over to the standby within the same attempt if the primary is unreachable
+	if opts.StandbyURI != "" {
+		endpoint := "primary"
+		if err != nil {
+			t.logf("Primary connection failed, trying standby: %s", dsn.RedactError(err, pgURI))
+			standbyCtx, standbyCancel := context.WithTimeout(parent, t.Timeout)
+			defer standbyCancel()
+
+			var standbyTrace *dialTrace
+			if trace != nil {
+				standbyTrace = &dialTrace{}
+			}
+			standbyDB, standbyErr := openDB(opts.Driver, opts.StandbyURI, "", onConnect, standbyTrace, opts.SourceAddr, opts.Proxy)
+			if standbyErr == nil {
+				defer standbyDB.Close()
+				standbyErr = standbyDB.PingContext(standbyCtx)
+			}
+
+			endpoint = "none"
+			if standbyErr == nil {
+				db, ctx, trace, endpoint = standbyDB, standbyCtx, standbyTrace, "standby"
+				connectedURI, connectedServerName = opts.StandbyURI, ""
+			}
+			err = standbyErr
+		}
+
+		// Full slice expression so the append never writes into the caller's backing array
+		customTags = append(customTags[:len(customTags):len(customTags)], "endpoint:"+endpoint)
+	}
+
+	// Try the failover servers in order within the same attempt if the URI's server is unreachable
+	if len(opts.FailoverHosts) > 0 {
+		index, host := "0", ""
+		if components, parseErr := dsn.ParseComponents(pgURI); parseErr == nil {
+			host = net.JoinHostPort(components.Host, components.Port)
+		}
+		if err != nil {
+			index = "none"
+			for i, failoverHost := range opts.FailoverHosts {
+				t.logf("Connection to %s failed, trying %s: %s", host, failoverHost, dsn.RedactError(err, pgURI))
+				failoverURI, uriErr := dsn.WithHost(pgURI, failoverHost)
+				if uriErr != nil {
+					err = uriErr
+					break
+				}
+				failoverCtx, failoverCancel := context.WithTimeout(parent, t.Timeout)
+				defer failoverCancel()
+
+				var failoverTrace *dialTrace
+				if trace != nil {
+					failoverTrace = &dialTrace{}
+				}
+				failoverDB, failoverErr := openDB(opts.Driver, failoverURI, opts.TLSServerName, onConnect, failoverTrace, opts.SourceAddr, opts.Proxy)
+				if failoverErr == nil {
+					defer failoverDB.Close()
+					failoverErr = failoverDB.PingContext(failoverCtx)
+				}
+
+				host, err = failoverHost, failoverErr
+				if err == nil {
+					db, ctx, trace, index = failoverDB, failoverCtx, failoverTrace, strconv.Itoa(i+1)
+					connectedURI = failoverURI
+					break
+				}
+			}
+		}
+
+		failoverTags := []string{"failover_index:" + index}
+		if index != "none" {
+			failoverTags = append(failoverTags, "host:"+host)
+		}
+		customTags = MergeTags(customTags, failoverTags)
+	}
+
+	// Calculate elapsed time
+	elapsedTime := time.Since(startTime)
+
+	if opts.TrackLocalPort {
+		localAddrMu.Lock()
+		addr := localAddr
+		localAddrMu.Unlock()
+		if addr != nil {
+			emitErrors += t.reportLocalAddr(client, addr, customTags)
+		}
+	}
+
+	// Tag whether the attempt reached the same server process as the last one, which a pooler
+	// in between may not preserve even when the persistent connection is reused
+	if err == nil && persistent != nil && opts.Driver == DefaultDriver {
+		var pid int
+		if pidErr := db.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid); pidErr != nil {
+			t.logf("Failed to query server process ID: %v", pidErr)
+		} else {
+			customTags = append(customTags[:len(customTags):len(customTags)], "conn_reused:"+strconv.FormatBool(pid == persistent.pid))
+			persistent.pid = pid
+		}
+	}
+
+	if err == nil && opts.LogBackendPID && opts.Driver == DefaultDriver && !reusing {
+		var pid int
+		if pidErr := db.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid); pidErr != nil {
+			t.logf("Failed to query server process ID: %v", pidErr)
+		} else {
+			t.logf("Connected to server process %d", pid)
+		}
+	}
+
+	// Reject replicas when a writable primary is required, and tag the server's role. The role
+	// check is timed on its own so it does not count against the connection or query latency.
+	notPrimary := false
+	if err == nil && (opts.RequirePrimary || (opts.DetectRole && opts.Driver == DefaultDriver)) {
+		var inRecovery bool
+		roleStart := time.Now()
+		roleErr := db.QueryRowContext(ctx, "SELECT pg_is_in_recovery()").Scan(&inRecovery)
+		roleLatency := time.Since(roleStart)
+
+		if opts.DetectRole {
+			role, roleStatus := roleTag(inRecovery), "success"
+			if roleErr != nil {
+				role, roleStatus = "role:unknown", "failure"
+			}
+			if err := client.RecordLatency(RoleCheckLatencyMetric, roleLatency, statusTags(customTags, roleStatus)); err != nil {
+				t.logf("Failed to emit role check latency metric: %v", err)
+				emitErrors++
+			}
+			customTags = append(customTags[:len(customTags):len(customTags)], role)
+		}
+
+		// Without RequirePrimary a failed check only leaves the role unknown
+		if opts.RequirePrimary {
+			err = roleErr
+			notPrimary = err == nil && inRecovery
+		} else if roleErr != nil {
+			t.logf("Failed to detect server role: %s", dsn.RedactError(roleErr, pgURI))
+		}
+	}
+
+	// Tag the server's major version, timing the extra query on its own. A persistent
+	// connection keeps the version it read until it reconnects.
+	if err == nil && opts.DetectVersion && opts.Driver == DefaultDriver {
+		version := ""
+		if persistent != nil {
+			version = persistent.version
+		}
+		if version == "" {
+			var serverVersion string
+			versionStart := time.Now()
+			versionErr := db.QueryRowContext(ctx, "SHOW server_version").Scan(&serverVersion)
+			versionLatency := time.Since(versionStart)
+
+			versionStatus := "success"
+			if versionErr != nil {
+				t.logf("Failed to detect server version: %s", dsn.RedactError(versionErr, pgURI))
+				version, versionStatus = "unknown", "failure"
+			} else {
+				version = majorVersion(serverVersion)
+				if persistent != nil {
+					persistent.version = version
+				}
+			}
+			if err := client.RecordLatency(VersionCheckLatencyMetric, versionLatency, statusTags(customTags, versionStatus)); err != nil {
+				t.logf("Failed to emit version check latency metric: %v", err)
+				emitErrors++
+			}
+		}
+		customTags = append(customTags[:len(customTags):len(customTags)], "pg_version:"+version)
+	}
+
+	// Compare the server's clock to ours, assuming the server read it halfway through the roundtrip.
+	// A failed check is only logged, since the skew says nothing about the connection's health.
+	if err == nil && opts.DetectSkew && opts.Driver == DefaultDriver {
+		var serverTime time.Time
+		skewStart := time.Now()
+		if skewErr := db.QueryRowContext(ctx, "SELECT now()").Scan(&serverTime); skewErr != nil {
+			t.logf("Failed to read server clock: %s", dsn.RedactError(skewErr, pgURI))
+		} else {
+			skew := serverTime.Sub(skewStart.Add(time.Since(skewStart) / 2))
+			if err := client.Gauge(ClockSkewMetric, skew.Seconds(), customTags); err != nil {
+				t.logf("Failed to emit clock skew metric: %v", err)
+				emitErrors++
+			}
+		}
+	}
+
+	// Report how long the server's certificate has left, failing the attempt if it is too short
+	certExpiring := false
+	if err == nil && opts.CheckCert && opts.Driver == DefaultDriver {
+		notAfter, certErr := serverCertificateExpiry(ctx, connectedURI, connectedServerName, opts.SourceAddr, opts.Proxy)
+		if certErr != nil {
+			t.logf("Failed to read server certificate: %s", dsn.RedactError(certErr, connectedURI))
+		} else {
+			days := time.Until(notAfter).Hours() / 24
+			if err := client.Gauge(CertDaysRemainingMetric, days, customTags); err != nil {
+				t.logf("Failed to emit certificate expiry metric: %v", err)
+				emitErrors++
+			}
+			if opts.CertWarnDays > 0 && days < float64(opts.CertWarnDays) {
+				certExpiring = true
+				if days < 0 {
+					t.logf("Server certificate expired on %s", notAfter.UTC().Format(time.RFC3339))
+				} else {
+					t.logf("Server certificate expires in %.1f days, on %s", days, notAfter.UTC().Format(time.RFC3339))
+				}
+			}
+		}
+	}
+
+	// Require a minimum number of healthy cluster nodes: the primary plus its streaming replicas
+	insufficientNodes := false
+	if err == nil && !notPrimary && opts.MinNodes > 0 {
+		var replicas int
+		err = db.QueryRowContext(ctx, "SELECT count(*) FROM pg_stat_replication WHERE state = 'streaming'").Scan(&replicas)
+		if err == nil {
+			nodes := replicas + 1
+			customTags = append(customTags[:len(customTags):len(customTags)], fmt.Sprintf("nodes:%d", nodes))
+			if nodes < opts.MinNodes {
+				insufficientNodes = true
+				t.logf("Only %d healthy node(s), but at least %d are required", nodes, opts.MinNodes)
+			}
+		}
+	}
+
+	// Treat rejections with an expected SQLSTATE as healthy, for negative health checks
+	expectedRejection := false
+	if err != nil && hasSQLState(err, opts.SuccessSQLStates) {
+		t.logf("Connection rejected with an expected SQLSTATE, treating as success: %s", dsn.RedactError(err, pgURI, opts.StandbyURI))
+		expectedRejection = true
+		err = nil
+	}
+
+	// Determine success or failure
+	success := err == nil && !notPrimary && !insufficientNodes && !certExpiring
+	status := "success"
+	// Category of a failed connection, tagged as failure_reason
+	reason := ""
+	var attemptErr error
+	if !success {
+		status = "failure"
+		attemptErr = err
+		if notPrimary {
+			status = "not_primary"
+			attemptErr = ErrNotPrimary
+			t.logf("Connected server is a replica in recovery, but a primary is required")
+		} else if insufficientNodes {
+			status = "insufficient_nodes"
+			attemptErr = ErrInsufficientNodes
+		} else if certExpiring {
+			status = "cert_expiring"
+			attemptErr = ErrCertExpiring
+		} else {
+			t.logf("Connection failed: %s", dsn.RedactError(err, pgURI, opts.StandbyURI))
+			reason = failureReason(ctx, err)
+		}
+	} else if opts.RequirePrimary && !opts.DetectRole {
+		customTags = append(customTags[:len(customTags):len(customTags)], "role:primary")
+	}
+	if success && authRefreshed {
+		status = "auth_refresh"
+	}
+
+	// Add or replace the status tag
+	tags := statusTags(customTags, status)
+	if reason != "" {
+		tags = append(tags, "failure_reason:"+reason)
+	}
+
+	// Record connection latency as distribution, tagged status:slo_breach when slower than the SLO
+	latencyTags := tags
+	connectionBreach := success && opts.MaxConnectionLatency > 0 && elapsedTime > opts.MaxConnectionLatency
+	if connectionBreach {
+		t.logf("Connection took %v, exceeding the SLO of %v", elapsedTime.Round(time.Microsecond), opts.MaxConnectionLatency)
+		latencyTags = statusTags(customTags, "slo_breach")
+	}
+	if err := client.RecordLatency(ConnectionLatencyMetric, elapsedTime, latencyTags); err != nil {
+		t.logf("Failed to emit latency metric: %v", err)
+		emitErrors++
+	}
+
+	// Compare the cold first connection with the warm attempts reusing the persistent connection
+	if success && persistent != nil {
+		if delta, ok := persistent.observeLatency(elapsedTime, warm); ok {
+			if err := client.Gauge(ColdWarmDeltaMetric, float64(delta.Microseconds())/1000, customTags); err != nil {
+				t.logf("Failed to emit cold/warm delta metric: %v", err)
+				emitErrors++
+			}
+		}
+	}
+
+	// Record the TCP connect and TLS handshake times of the connection
+	var tcpLatency, tlsLatency time.Duration
+	if trace != nil {
+		var dialed, handshake bool
+		tcpLatency, dialed, tlsLatency, handshake = trace.durations()
+		if dialed {
+			if err := client.RecordLatency(TCPLatencyMetric, tcpLatency, tags); err != nil {
+				t.logf("Failed to emit TCP latency metric: %v", err)
+				emitErrors++
+			}
+		}
+		if handshake {
+			if err := client.RecordLatency(TLSLatencyMetric, tlsLatency, tags); err != nil {
+				t.logf("Failed to emit TLS latency metric: %v", err)
+				emitErrors++
+			}
+		}
+	}
+
+	// Record how many retries the connection needed, even when it finally succeeded
+	if opts.Retries > 0 {
+		if err := client.Count(RetriesMetric, int64(retries), tags); err != nil {
+			t.logf("Failed to emit retries metric: %v", err)
+			emitErrors++
+		}
+	}
+
+	// There is no usable connection after an expected rejection, so the attempt ends here
+	if expectedRejection {
+		if err := client.Count(AttemptCountMetric, 1, tags); err != nil {
+			t.logf("Failed to emit attempt metric: %v", err)
+			emitErrors++
+		}
+		return Result{Success: true, Status: status, ConnectionLatency: elapsedTime, TCPLatency: tcpLatency, TLSLatency: tlsLatency, Tags: customTags}, nil
+	}
+
+	// If connection was successful, run a test query and measure its latency
+	var queryLatency time.Duration
+	var queryStatus string
+	if success && !opts.SkipQuery {
+		// Bound the query separately so a slow query is not attributed to the connection timeout
+		queryCtx, queryCancel := context.WithTimeout(parent, opts.QueryTimeout)
+		defer queryCancel()
+
+		// Tag the query's metrics with the hash of its plan, counting a change from the baseline
+		if opts.Plans != nil && len(opts.Script) == 0 {
+			if hash, planErr := explainPlan(queryCtx, db, opts.Query); planErr != nil {
+				t.logf("Failed to explain the test query: %s", dsn.RedactError(planErr, pgURI, opts.StandbyURI))
+			} else {
+				customTags = append(customTags[:len(customTags):len(customTags)], "plan_hash:"+hash)
+				if baseline, changed := opts.Plans.observe(hash); changed {
+					t.logf("Test query plan changed from %s to %s", baseline, hash)
+					if err := client.Count(PlanChangeMetric, 1, customTags); err != nil {
+						t.logf("Failed to emit plan change metric: %v", err)
+						emitErrors++
+					}
+				}
+			}
+		}
+
+		queryStart := time.Now()
+		stalled := false
+		rowCount := 1
+		// First column of the result, checked against Expect when set, and whether it was read
+		var actual any
+		scanned := false
+		// Time until the first row arrived, zero when it did not or was not timed
+		var firstRow time.Duration
+		// Hash of every row read, when ResultHashes is set
+		var resultHash string
+		// Phase timings of a transaction probe, and the phase that failed, if any
+		var phases txPhases
+		var failedPhase string
+		if len(opts.Script) > 0 {
+			err = runScript(queryCtx, db, opts.Script, opts.ReadOnly)
+		} else if opts.TxProbe {
+			actual, phases, failedPhase, err = runTransaction(queryCtx, db, opts.Query, opts.ReadOnly)
+			scanned = true
+		} else {
+			budget := &byteBudget{max: opts.MaxResultBytes}
+			err = inRolledBackTx(queryCtx, db, opts.ReadOnly, opts.Rollback, func(q rowQuerier) error {
+				var err error
+				if opts.RowTimeout > 0 {
+					rowCount, stalled, err = runStreamingQuery(queryCtx, q, opts.Query, opts.RowTimeout, budget)
+				} else if opts.RowCount != nil {
+					rowCount, err = countRows(queryCtx, q, opts.Query, opts.RowCount.limit(), budget)
+				} else if opts.ExpectSingleRow {
+					rowCount, err = countRows(queryCtx, q, opts.Query, 0, budget)
+				} else if opts.FailIfEmpty {
+					rowCount, err = countRows(queryCtx, q, opts.Query, 1, budget)
+				} else if opts.ResultHashes != nil {
+					rowCount, resultHash, err = hashRows(queryCtx, q, opts.Query, budget)
+				} else {
+					actual, firstRow, err = queryFirstColumn(queryCtx, q, opts.Query)
+					scanned = true
+				}
+				return err
+			})
+		}
+		queryLatency = time.Since(queryStart)
+		queryTimedOut := err != nil && errors.Is(queryCtx.Err(), context.DeadlineExceeded)
+		tooLarge := errors.Is(err, errResultTooLarge)
+
+		if err != nil && hasSQLState(err, opts.SuccessSQLStates) {
+			t.logf("Test query rejected with an expected SQLSTATE, treating as success: %s", dsn.RedactError(err, pgURI, opts.StandbyURI))
+			err, failedPhase = nil, ""
+		}
+
+		// Time each phase of the transaction that ran, the failed one tagged status:tx_failure
+		if opts.TxProbe && len(opts.Script) == 0 {
+			for _, phase := range []struct {
+				name    string
+				latency time.Duration
+			}{{"begin", phases.begin}, {"query", phases.query}, {"commit", phases.commit}} {
+				if phase.latency == 0 {
+					// The phases run in order, so this one and the rest never started
+					break
+				}
+				phaseStatus := "success"
+				if phase.name == failedPhase {
+					phaseStatus = "tx_failure"
+				}
+				if err := client.RecordLatency(TxLatencyMetric, phase.latency, statusTags(customTags, phaseStatus, "tx_phase:"+phase.name)); err != nil {
+					t.logf("Failed to emit transaction phase latency metric: %v", err)
+					emitErrors++
+				}
+			}
+		}
+
+		unexpectedRows := opts.ExpectSingleRow && err == nil && !stalled && rowCount > 1
+		emptyResult := opts.FailIfEmpty && err == nil && rowCount == 0
+		rowCountFailed := opts.RowCount != nil && err == nil && !opts.RowCount.contains(rowCount)
+		if opts.RowCount != nil && err == nil {
+			if err := client.Gauge(RowCountMetric, float64(rowCount), customTags); err != nil {
+				t.logf("Failed to emit row count metric: %v", err)
+				emitErrors++
+			}
+		}
+		// Tag the query's metrics with the hash of its result, counting a change from the last attempt's
+		var hashTags []string
+		if resultHash != "" && err == nil {
+			hashTags = []string{"result_hash:" + resultHash}
+			if previous, changed := opts.ResultHashes.observe(resultHash); changed {
+				t.logf("Test query result changed from %s to %s", previous, resultHash)
+				if err := client.Count(ResultChangeMetric, 1, append(customTags[:len(customTags):len(customTags)], hashTags...)); err != nil {
+					t.logf("Failed to emit result change metric: %v", err)
+					emitErrors++
+				}
+			}
+		}
+		if opts.LogQueryResult && scanned && err == nil {
+			t.logf("Test query returned %s", formatValue(actual))
+		}
+		assertionFailed := scanned && opts.Expect != "" && err == nil && !matchesExpected(actual, opts.Expect)
+
+		if err != nil || stalled || unexpectedRows || emptyResult || rowCountFailed || assertionFailed {
+			queryStatus = "query_failure"
+			if stalled {
+				t.logf("Test query stalled: a row took longer than %v to arrive", opts.RowTimeout)
+				queryStatus = "stream_stall"
+			} else if unexpectedRows {
+				t.logf("Test query returned %d rows, expected a single row", rowCount)
+				queryStatus = "unexpected_rows"
+			} else if emptyResult {
+				t.logf("Test query returned no rows")
+				queryStatus = "empty_result"
+			} else if rowCountFailed {
+				t.logf("Test query returned %d rows, expected %v", rowCount, *opts.RowCount)
+				queryStatus = "row_count_failure"
+			} else if assertionFailed {
+				t.logf("Test query returned %q, expected %q", formatValue(actual), opts.Expect)
+				queryStatus = "assertion_failure"
+			} else if tooLarge {
+				t.logf("Test query result exceeded %d bytes, stopped reading it", opts.MaxResultBytes)
+				queryStatus = "result_too_large"
+			} else if failedPhase != "" {
+				t.logf("Transaction probe failed at %s: %s", failedPhase, dsn.RedactError(err, pgURI, opts.StandbyURI))
+				queryStatus = "tx_failure"
+			} else if opts.ReadOnly && hasSQLState(err, []string{readOnlySQLState}) {
+				t.logf("Test query attempted a write in a read-only transaction: %s", dsn.RedactError(err, pgURI, opts.StandbyURI))
+			} else if queryTimedOut {
+				t.logf("Test query timed out after %v", opts.QueryTimeout)
+				queryStatus = "query_timeout"
+			} else {
+				t.logf("Test query failed: %s", dsn.RedactError(err, pgURI, opts.StandbyURI))
+			}
+			// Query failed, but connection was successful
+			queryTags := statusTags(customTags, queryStatus)
+			if failedPhase != "" {
+				queryTags = append(queryTags, "tx_phase:"+failedPhase)
+			}
+
+			// Record query latency even on failure
+			if err := client.RecordLatency(QueryLatencyMetric, queryLatency, queryTags); err != nil {
+				t.logf("Failed to emit query latency metric: %v", err)
+				emitErrors++
+			}
+			if firstRow > 0 {
+				if err := client.RecordLatency(QueryTTFBMetric, firstRow, queryTags); err != nil {
+					t.logf("Failed to emit query time to first row metric: %v", err)
+					emitErrors++
+				}
+			}
+		} else {
+			// Query successful, though possibly slower than the SLO
+			queryStatus = "success"
+			if opts.MaxQueryLatency > 0 && queryLatency > opts.MaxQueryLatency {
+				t.logf("Test query took %v, exceeding the SLO of %v", queryLatency.Round(time.Microsecond), opts.MaxQueryLatency)
+				queryStatus = "slo_breach"
+			}
+			queryTags := statusTags(customTags, queryStatus, hashTags...)
+
+			// Record query latency, and separately how much of it was spent before the first row
+			if err := client.RecordLatency(QueryLatencyMetric, queryLatency, queryTags); err != nil {
+				t.logf("Failed to emit query latency metric: %v", err)
+				emitErrors++
+			}
+			if firstRow > 0 {
+				if err := client.RecordLatency(QueryTTFBMetric, firstRow, queryTags); err != nil {
+					t.logf("Failed to emit query time to first row metric: %v", err)
+					emitErrors++
+				}
+			}
+		}
+
+		// An empty result fails the whole attempt, not only the query
+		if emptyResult {
+			success = false
+			status, attemptErr = "empty_result", ErrEmptyResult
+		}
+	}
+
+	// Measure how long a larger result takes to transfer
+	if success && opts.PayloadSize > 0 {
+		transferStart := time.Now()
+		received, transferErr := fetchPayload(ctx, db, opts.PayloadSize)
+		transferLatency := time.Since(transferStart)
+
+		transferStatus := "success"
+		if transferErr != nil {
+			t.logf("Payload transfer failed: %v", transferErr)
+			transferStatus = "failure"
+		}
+		transferTags := statusTags(customTags, transferStatus)
+		if err := client.RecordLatency(TransferLatencyMetric, transferLatency, transferTags); err != nil {
+			t.logf("Failed to emit transfer latency metric: %v", err)
+			emitErrors++
+		}
+		if transferErr == nil && transferLatency > 0 {
+			throughput := float64(received) / transferLatency.Seconds()
+			if err := client.Gauge(TransferRateMetric, throughput, transferTags); err != nil {
+				t.logf("Failed to emit transfer throughput metric: %v", err)
+				emitErrors++
+			}
+		}
+	}
+
+	// Record how loaded the server is, to correlate with probe latency
+	if success && opts.MeasureLoad {
+		var serverConns int
+		if loadErr := db.QueryRowContext(ctx, "SELECT count(*) FROM pg_stat_activity").Scan(&serverConns); loadErr != nil {
+			t.logf("Failed to count server connections: %v", loadErr)
+		} else if err := client.Gauge(ServerConnsMetric, float64(serverConns), customTags); err != nil {
+			t.logf("Failed to emit server connections metric: %v", err)
+			emitErrors++
+		}
+	}
+
+	// Capture the pooler's view of the target database
+	if success && opts.PgBouncer {
+		emitErrors += t.reportPgBouncer(ctx, client, customTags)
+	}
+
+	// Track how many distinct servers have answered, e.g. during a rolling restart
+	if success && opts.Backends != nil {
+		distinct, backendErr := opts.Backends.observe(ctx, db)
+		if backendErr != nil {
+			t.logf("Failed to identify backend server: %v", backendErr)
+		} else if err := client.Gauge(DistinctBackendsMetric, float64(distinct), customTags); err != nil {
+			t.logf("Failed to emit distinct backends metric: %v", err)
+			emitErrors++
+		}
+	}
+
+	// Report the state of the pool the persistent connection is kept in
+	if persistent != nil {
+		emitErrors += persistent.reportStats(client, customTags)
+	}
+
+	// Time the whole attempt, excluding the deliberate hold below
+	attemptDuration := time.Since(startTime)
+
+	// Verify the connection survives being held open
+	if success && opts.Hold > 0 {
+		held, holdErr := holdConnection(db, opts.Hold, opts.HoldInterval, t.Timeout)
+		holdStatus := "success"
+		if holdErr != nil {
+			t.logf("Connection dropped after %v of %v hold: %v", held.Round(time.Millisecond), opts.Hold, holdErr)
+			holdStatus = "hold_failure"
+			success = false
+			status, attemptErr = holdStatus, holdErr
+		}
+		if err := client.RecordLatency(HoldDurationMetric, held, statusTags(customTags, holdStatus)); err != nil {
+			t.logf("Failed to emit hold duration metric: %v", err)
+			emitErrors++
+		}
+	}
+
+	// Record the attempt's duration and count with its final status, once a failed hold has set it
+	attemptStatus := status
+	if opts.OutlierThreshold > 0 && attemptDuration > opts.OutlierThreshold {
+		t.logf("Attempt took %v, exceeding the outlier threshold of %v", attemptDuration.Round(time.Millisecond), opts.OutlierThreshold)
+		attemptStatus = "outlier"
+	}
+	if err := client.RecordLatency(AttemptDurationMetric, attemptDuration, statusTags(customTags, attemptStatus)); err != nil {
+		t.logf("Failed to emit attempt duration metric: %v", err)
+		emitErrors++
+	}
+	tags = statusTags(customTags, status)
+	if reason != "" {
+		tags = append(tags, "failure_reason:"+reason)
+	}
+	if err := client.Count(AttemptCountMetric, 1, tags); err != nil {
+		t.logf("Failed to emit attempt metric: %v", err)
+		emitErrors++
+	}
+
+	return Result{Success: success, Status: status, ConnectionLatency: elapsedTime, QueryLatency: queryLatency,
+		QueryStatus: queryStatus, FailureReason: reason, SLOBreach: connectionBreach || queryStatus == "slo_breach",
+		TCPLatency: tcpLatency, TLSLatency: tlsLatency, Tags: customTags}, attemptErr
+}
+
+// queryFailed reports whether a test query with this status failed, rather than succeeding,
+// possibly slower than the SLO, or not running
+func queryFailed(queryStatus string) bool {
+	return queryStatus != "" && queryStatus != "success" && queryStatus != "slo_breach"
+}
+
+// roleTag returns the role tag for the result of pg_is_in_recovery()
+func roleTag(inRecovery bool) string {
+	if inRecovery {
+		return "role:replica"
+	}
+	return "role:primary"
+}
+
+// majorVersion coarsens a server_version such as "15.4 (Debian 15.4-1)" to its major version:
+// the first number from PostgreSQL 10 on, and the first two before, e.g. 15 or 9.6
+func majorVersion(serverVersion string) string {
+	fields := strings.Fields(serverVersion)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	parts := strings.Split(fields[0], ".")
+	if major, err := strconv.Atoi(parts[0]); err == nil && major < 10 && len(parts) > 1 {
+		return parts[0] + "." + parts[1]
+	}
+	return parts[0]
+}
+
+// sleepContext waits for d, returning false if ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// readOnlySQLState is the SQLSTATE of a write attempted in a read-only transaction
+const readOnlySQLState = "25006"
+
+// hasSQLState reports whether err is a PostgreSQL error whose SQLSTATE code is in codes
+func hasSQLState(err error, codes []string) bool {
+	var pqErr *pq.Error
+	if len(codes) == 0 || !errors.As(err, &pqErr) {
+		return false
+	}
+	return slices.Contains(codes, string(pqErr.Code))
+}
+
+// statusTags returns a copy of customTags with the status tag set, replacing any user-supplied
+// one, followed by extras
+func statusTags(customTags []string, status string, extras ...string) []string {
+	tags := make([]string, 0, len(customTags)+1+len(extras))
+	statusAdded := false
+	for _, tag := range customTags {
+		if strings.HasPrefix(tag, "status:") {
+			tag = "status:" + status
+			statusAdded = true
+		}
+		tags = append(tags, tag)
+	}
+
+	if !statusAdded {
+		tags = append(tags, "status:"+status)
+	}
+	return append(tags, extras...)
+}
+
+// reportLocalAddr logs the local address of a connection and counts it by local port bucket.
+// It returns the number of metric emissions that failed.
+func (t *Tester) reportLocalAddr(client Backend, addr net.Addr, customTags []string) int {
+	t.logf("Connected from local address %s", addr)
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return 0
+	}
+	// Bucket ports in blocks of 1024 to keep tag cardinality low
+	bucket := tcpAddr.Port / 1024 * 1024
+	tags := append(customTags[:len(customTags):len(customTags)], fmt.Sprintf("port_bucket:%d", bucket))
+	if err := client.Count(LocalPortMetric, 1, tags); err != nil {
+		t.logf("Failed to emit local port metric: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// EmitStartupBaseline emits zero values for the core metrics tagged status:startup
+func EmitStartupBaseline(client Backend, customTags []string) {
+	tags := statusTags(customTags, "startup")
+	if err := client.Count(AttemptCountMetric, 0, tags); err != nil {
+		log.Printf("Failed to emit startup attempt metric: %v", err)
+	}
+	if err := client.RecordLatency(ConnectionLatencyMetric, 0, tags); err != nil {
+		log.Printf("Failed to emit startup latency metric: %v", err)
+	}
+	if err := client.RecordLatency(QueryLatencyMetric, 0, tags); err != nil {
+		log.Printf("Failed to emit startup query latency metric: %v", err)
+	}
+}
+
+// reportEmitErrors logs failed metric emissions to stderr and emits a self-metric counting them
+func reportEmitErrors(client Backend, count int, customTags []string) {
+	if count == 0 {
+		return
+	}
+
+	log.Printf("%d metric emission(s) failed during this attempt", count)
+	if err := client.Count(EmitErrorsMetric, int64(count), customTags); err != nil {
+		log.Printf("Failed to emit %s metric: %v", EmitErrorsMetric, err)
+	}
+}
@@ -0,0 +1,23 @@
+package conntester
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/chalk/conntester/internal/dsn"
+)
+
+// ReadCredentialFile returns pgURI with its password replaced by the contents of the file at
+// path, such as a secret mounted by a secrets manager, trimmed of surrounding whitespace
+func ReadCredentialFile(pgURI, path string) (string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	password := strings.TrimSpace(string(contents))
+	if password == "" {
+		return "", fmt.Errorf("credential file %s is empty", path)
+	}
+	return dsn.SetPassword(pgURI, password)
+}
@@ -0,0 +1,193 @@
+package conntester
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/chalk/conntester/internal/dsn"
+	"github.com/lib/pq"
+	"golang.org/x/net/proxy"
+)
+
+// probeDialer is the lib/pq dialer used when the probe needs control over connection setup
+type probeDialer struct {
+	// Address to dial instead of the one the driver asks for, empty to use the driver's
+	addr string
+	// Called with every newly established connection, may be nil
+	onConnect func(net.Conn)
+	// Records the TCP connect and TLS handshake times, may be nil
+	trace *dialTrace
+	// Local IP TCP connections are made from, nil to let the OS choose
+	sourceIP net.IP
+	// SOCKS5 proxy TCP connections are made through, nil to connect directly
+	proxyURL *url.URL
+	d        net.Dialer
+}
+
+// proxyError is a failure to connect through the proxy, reported as failure_reason:proxy
+type proxyError struct {
+	err error
+}
+
+func (e *proxyError) Error() string {
+	return "proxy: " + e.err.Error()
+}
+
+func (e *proxyError) Unwrap() error {
+	return e.err
+}
+
+func (p probeDialer) Dial(network, address string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, address)
+}
+
+func (p probeDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return p.DialContext(ctx, network, address)
+}
+
+func (p probeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if p.addr != "" {
+		address = p.addr
+	}
+
+	// Time the TCP connect from the socket's creation, after the host lookup, so the
+	// metric does not overlap the separately reported DNS duration
+	d := p.d
+	if p.sourceIP != nil && strings.HasPrefix(network, "tcp") {
+		d.LocalAddr = &net.TCPAddr{IP: p.sourceIP}
+	}
+	if p.proxyURL != nil && strings.HasPrefix(network, "tcp") {
+		return p.dialProxy(ctx, d, network, address)
+	}
+	var connectStart atomic.Int64
+	if p.trace != nil {
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			connectStart.Store(time.Now().UnixNano())
+			return nil
+		}
+	}
+
+	conn, err := d.DialContext(ctx, network, address)
+	if started := connectStart.Load(); started != 0 {
+		if p.trace.recordTCP(time.Since(time.Unix(0, started)), err) && err == nil {
+			conn = &tracedConn{Conn: conn, trace: p.trace}
+		}
+	}
+	if err == nil && p.onConnect != nil {
+		p.onConnect(conn)
+	}
+	return conn, err
+}
+
+// dialProxy connects to address through the SOCKS5 proxy, which also resolves the host. The
+// TCP connect time covers the whole proxied dial, including the proxy's own connection.
+func (p probeDialer) dialProxy(ctx context.Context, d net.Dialer, network, address string) (net.Conn, error) {
+	dialer, err := proxy.FromURL(p.proxyURL, &d)
+	if err != nil {
+		return nil, &proxyError{err}
+	}
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, &proxyError{fmt.Errorf("unsupported proxy scheme %q", p.proxyURL.Scheme)}
+	}
+
+	start := time.Now()
+	conn, err := contextDialer.DialContext(ctx, network, address)
+	if err != nil {
+		err = &proxyError{err}
+	}
+	if p.trace != nil && p.trace.recordTCP(time.Since(start), err) && err == nil {
+		conn = &tracedConn{Conn: conn, trace: p.trace}
+	}
+	if err == nil && p.onConnect != nil {
+		p.onConnect(conn)
+	}
+	return conn, err
+}
+
+// openDB opens a database handle for connStr with the named driver. When tlsServerName is set, the
+// server certificate and SNI are checked against it instead of the host in the DSN. When onConnect
+// is set, it is called with every connection the driver establishes. When trace is set, it records
+// the TCP connect and TLS handshake times of the first connection. When sourceAddr is set, TCP
+// connections are made from that local IP. When proxyURL is set, TCP connections go through that
+// SOCKS5 proxy. All five require the postgres driver.
+func openDB(driver, connStr string, tlsServerName string, onConnect func(net.Conn), trace *dialTrace, sourceAddr, proxyURL string) (*sql.DB, error) {
+	if tlsServerName == "" && onConnect == nil && trace == nil && sourceAddr == "" && proxyURL == "" {
+		return sql.Open(driver, connStr)
+	}
+	if driver != "postgres" {
+		return nil, fmt.Errorf("TLS server name, local address tracking, dial tracing, source addresses, and proxies require the postgres driver, not %s", driver)
+	}
+
+	dialer := probeDialer{onConnect: onConnect, trace: trace}
+	if sourceAddr != "" {
+		if dialer.sourceIP = net.ParseIP(sourceAddr); dialer.sourceIP == nil {
+			return nil, fmt.Errorf("source address %q is not an IP address", sourceAddr)
+		}
+	}
+	if proxyURL != "" {
+		var err error
+		if dialer.proxyURL, err = url.Parse(proxyURL); err != nil {
+			return nil, &proxyError{err}
+		}
+	}
+	if tlsServerName != "" {
+		components, err := dsn.ParseComponents(connStr)
+		if err != nil {
+			return nil, err
+		}
+		host := components.Host
+		if host == "" {
+			host = "localhost"
+		}
+		if strings.HasPrefix(host, "/") {
+			return nil, fmt.Errorf("a TLS server name cannot be used with a Unix socket host")
+		}
+
+		// lib/pq verifies the certificate against the host parameter, so present the override
+		// as the host while dialing the address from the original DSN
+		connStr, err = dsn.SetParam(connStr, "host", tlsServerName)
+		if err != nil {
+			return nil, err
+		}
+		dialer.addr = net.JoinHostPort(host, components.Port)
+	}
+
+	connector, err := pq.NewConnector(connStr)
+	if err != nil {
+		return nil, err
+	}
+	connector.Dialer(dialer)
+
+	return sql.OpenDB(connector), nil
+}
+
+// resolveHost looks up the host in connStr and returns how long the lookup took. It reports
+// resolved=false, with no error, when there is nothing to look up: a Unix socket or IP literal
+// host, or a DSN that does not parse (the connection attempt reports that instead).
+func resolveHost(ctx context.Context, connStr string) (latency time.Duration, resolved bool, err error) {
+	components, err := dsn.ParseComponents(connStr)
+	if err != nil {
+		return 0, false, nil
+	}
+	host := components.Host
+	if host == "" {
+		host = "localhost"
+	}
+	if strings.HasPrefix(host, "/") || net.ParseIP(host) != nil {
+		return 0, false, nil
+	}
+
+	start := time.Now()
+	_, err = net.DefaultResolver.LookupHost(ctx, host)
+	return time.Since(start), true, err
+}
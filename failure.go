@@ -0,0 +1,51 @@
+package conntester
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/lib/pq"
+)
+
+// failureReason classifies why a connection failed, for the failure_reason tag: proxy, dns,
+// timeout, connection_refused, tls, auth, or unknown. An error after ctx's deadline counts as a timeout,
+// since lib/pq does not always return the context's error when the deadline interrupts it.
+func failureReason(ctx context.Context, err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var pqErr *pq.Error
+	var proxyErr *proxyError
+	switch {
+	// The proxy reports failures to reach the server as its own, so they come first
+	case errors.As(err, &proxyErr):
+		return "proxy"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(ctx.Err(), context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case isTLSError(err):
+		return "tls"
+	// Class 28 is invalid authorization: a wrong password or no matching pg_hba.conf entry
+	case errors.As(err, &pqErr) && pqErr.Code.Class() == "28":
+		return "auth"
+	}
+	return "unknown"
+}
+
+// isTLSError reports whether err came from the TLS handshake or certificate verification
+func isTLSError(err error) bool {
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.Is(err, pq.ErrSSLNotSupported) || errors.As(err, &recordErr) || errors.As(err, &alertErr) ||
+		errors.As(err, &verifyErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
@@ -0,0 +1,60 @@
+package conntester
+
+import (
+	"errors"
+	"time"
+)
+
+// FanoutBackend emits every metric to several Backends, e.g. two StatsD agents during a
+// migration. Every backend is called even when another fails, and their errors are joined.
+type FanoutBackend struct {
+	backends []Backend
+}
+
+// NewFanoutBackend returns a Backend that emits to each of backends
+func NewFanoutBackend(backends ...Backend) *FanoutBackend {
+	return &FanoutBackend{backends: backends}
+}
+
+func (b *FanoutBackend) RecordLatency(name string, latency time.Duration, tags []string) error {
+	return b.each(func(backend Backend) error {
+		return backend.RecordLatency(name, latency, tags)
+	})
+}
+
+func (b *FanoutBackend) Count(name string, value int64, tags []string) error {
+	return b.each(func(backend Backend) error {
+		return backend.Count(name, value, tags)
+	})
+}
+
+func (b *FanoutBackend) Gauge(name string, value float64, tags []string) error {
+	return b.each(func(backend Backend) error {
+		return backend.Gauge(name, value, tags)
+	})
+}
+
+func (b *FanoutBackend) RecoveryEvent(title, text string, tags []string) error {
+	return b.each(func(backend Backend) error {
+		return backend.RecoveryEvent(title, text, tags)
+	})
+}
+
+func (b *FanoutBackend) Flush() error {
+	return b.each(Backend.Flush)
+}
+
+func (b *FanoutBackend) Close() error {
+	return b.each(Backend.Close)
+}
+
+// each calls fn on every backend and joins the errors
+func (b *FanoutBackend) each(fn func(Backend) error) error {
+	var errs []error
+	for _, backend := range b.backends {
+		if err := fn(backend); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
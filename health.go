@@ -0,0 +1,85 @@
+package conntester
+
+import (
+	"log"
+	"time"
+)
+
+// HealthTracker combines recent success rate and latency headroom into a 0-100 score
+type HealthTracker struct {
+	// Number of recent attempts considered
+	window int
+	// Connection latency at which the latency component of the score reaches zero
+	latencyThreshold time.Duration
+	successWeight    float64
+	latencyWeight    float64
+
+	successes []bool
+	latencies []time.Duration
+}
+
+// NewHealthTracker returns a tracker for Options.Health scoring the last window attempts
+func NewHealthTracker(window int, latencyThreshold time.Duration, successWeight, latencyWeight float64) *HealthTracker {
+	if window < 1 {
+		window = 1
+	}
+	return &HealthTracker{
+		window:           window,
+		latencyThreshold: latencyThreshold,
+		successWeight:    successWeight,
+		latencyWeight:    latencyWeight,
+	}
+}
+
+// record adds an attempt to the window, dropping the oldest once it is full
+func (h *HealthTracker) record(success bool, latency time.Duration) {
+	h.successes = append(h.successes, success)
+	if success {
+		h.latencies = append(h.latencies, latency)
+	} else {
+		h.latencies = append(h.latencies, 0)
+	}
+
+	if len(h.successes) > h.window {
+		h.successes = h.successes[1:]
+		h.latencies = h.latencies[1:]
+	}
+}
+
+// score returns the weighted health score over the current window
+func (h *HealthTracker) score() float64 {
+	if len(h.successes) == 0 || h.successWeight+h.latencyWeight <= 0 {
+		return 0
+	}
+
+	succeeded := 0
+	var totalLatency time.Duration
+	for i, success := range h.successes {
+		if success {
+			succeeded++
+			totalLatency += h.latencies[i]
+		}
+	}
+	successRate := float64(succeeded) / float64(len(h.successes))
+
+	// Headroom is how far the mean successful latency sits below the threshold
+	headroom := 0.0
+	if succeeded > 0 && h.latencyThreshold > 0 {
+		meanLatency := totalLatency / time.Duration(succeeded)
+		headroom = 1 - float64(meanLatency)/float64(h.latencyThreshold)
+		if headroom < 0 {
+			headroom = 0
+		}
+	}
+
+	weighted := h.successWeight*successRate + h.latencyWeight*headroom
+	return 100 * weighted / (h.successWeight + h.latencyWeight)
+}
+
+// emit records the latest attempt and sends the resulting score as a gauge
+func (h *HealthTracker) emit(client Backend, success bool, latency time.Duration, customTags []string) {
+	h.record(success, latency)
+	if err := client.Gauge(HealthScoreMetric, h.score(), customTags); err != nil {
+		log.Printf("Failed to emit health score metric: %v", err)
+	}
+}
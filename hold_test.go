@@ -0,0 +1,134 @@
+package conntester
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// holdDriver opens connections whose pings succeed failAfter times and then fail, as a server
+// that accepts a connection and drops it shortly afterward
+type holdDriver struct {
+	failAfter int64
+	pings     atomic.Int64
+}
+
+func (d *holdDriver) Open(name string) (driver.Conn, error) {
+	return &holdConn{driver: d}, nil
+}
+
+type holdConn struct {
+	driver *holdDriver
+}
+
+func (c *holdConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *holdConn) Close() error {
+	return nil
+}
+
+func (c *holdConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *holdConn) Ping(ctx context.Context) error {
+	if c.driver.pings.Add(1) > c.driver.failAfter {
+		return errors.New("connection reset by peer")
+	}
+	return nil
+}
+
+// recordedMetric is one emission to a recordingBackend
+type recordedMetric struct {
+	name string
+	tags []string
+}
+
+// recordingBackend keeps every metric emitted to it
+type recordingBackend struct {
+	mu      sync.Mutex
+	metrics []recordedMetric
+}
+
+func (b *recordingBackend) record(name string, tags []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.metrics = append(b.metrics, recordedMetric{name: name, tags: slices.Clone(tags)})
+	return nil
+}
+
+func (b *recordingBackend) RecordLatency(name string, latency time.Duration, tags []string) error {
+	return b.record(name, tags)
+}
+
+func (b *recordingBackend) Count(name string, value int64, tags []string) error {
+	return b.record(name, tags)
+}
+
+func (b *recordingBackend) Gauge(name string, value float64, tags []string) error {
+	return b.record(name, tags)
+}
+
+func (b *recordingBackend) RecoveryEvent(title, text string, tags []string) error { return nil }
+func (b *recordingBackend) Flush() error                                          { return nil }
+func (b *recordingBackend) Close() error                                          { return nil }
+
+// tagsOf returns the tags of every emission of the named metric
+func (b *recordingBackend) tagsOf(name string) [][]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var tags [][]string
+	for _, metric := range b.metrics {
+		if metric.name == name {
+			tags = append(tags, metric.tags)
+		}
+	}
+	return tags
+}
+
+func init() {
+	// The connect ping succeeds and every ping during the hold fails
+	sql.Register("conntester-hold-test", &holdDriver{failAfter: 1})
+}
+
+func TestHoldFailureFailsAttemptMetrics(t *testing.T) {
+	backend := &recordingBackend{}
+	tester := Tester{
+		URI:     "hold-test",
+		Timeout: 5 * time.Second,
+		Backend: backend,
+		Tags:    []string{"env:test"},
+		Options: Options{
+			Driver:       "conntester-hold-test",
+			SkipQuery:    true,
+			Hold:         time.Second,
+			HoldInterval: 10 * time.Millisecond,
+		},
+	}
+
+	result, err := tester.Run(context.Background())
+	if err == nil {
+		t.Fatal("Run returned no error for a connection dropped during the hold")
+	}
+	if result.Success || result.Status != "hold_failure" {
+		t.Fatalf("got success %v and status %q, want a failed attempt with status hold_failure", result.Success, result.Status)
+	}
+
+	for _, name := range []string{AttemptCountMetric, AttemptDurationMetric, HoldDurationMetric} {
+		emitted := backend.tagsOf(name)
+		if len(emitted) != 1 {
+			t.Fatalf("%s emitted %d times, want once", name, len(emitted))
+		}
+		if !slices.Contains(emitted[0], "status:hold_failure") {
+			t.Errorf("%s tagged %v, want status:hold_failure", name, emitted[0])
+		}
+	}
+}
@@ -0,0 +1,542 @@
+// Package dsn parses and rewrites PostgreSQL connection strings in both the postgres:// URI
+// form and the libpq keyword/value form.
+package dsn
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Default PostgreSQL port used when the DSN does not specify one
+const defaultPort = "5432"
+
+// Components holds the parts of a connection URI exposed to --name-template
+type Components struct {
+	Host   string
+	Port   string
+	DBName string
+	User   string
+}
+
+// IsURIForm reports whether the DSN uses the postgres:// URI form rather than keyword/value pairs
+func IsURIForm(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// ParseComponents extracts the host, port, database name, and user from either a
+// postgres:// URI or a keyword/value DSN such as "host=db1 port=5432 dbname=app"
+func ParseComponents(pgURI string) (Components, error) {
+	if !IsURIForm(pgURI) {
+		return parseKeywordComponents(pgURI)
+	}
+
+	u, err := url.Parse(pgURI)
+	if err != nil {
+		// url.Error embeds the full URI, which may contain a password
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return Components{}, fmt.Errorf("invalid connection URI: %w", err)
+	}
+
+	query := u.Query()
+	components := Components{
+		Host:   uriParam(u, query, "host"),
+		Port:   uriParam(u, query, "port"),
+		DBName: uriParam(u, query, "dbname"),
+		User:   uriParam(u, query, "user"),
+	}
+	if components.Port == "" {
+		components.Port = defaultPort
+	}
+
+	return components, nil
+}
+
+// uriParam returns a connection parameter of a parsed URI, taking a query parameter over the
+// corresponding part of the URI as lib/pq does
+func uriParam(u *url.URL, query url.Values, key string) string {
+	if value := query.Get(key); value != "" {
+		return value
+	}
+	switch key {
+	case "host":
+		return u.Hostname()
+	case "port":
+		return u.Port()
+	case "dbname":
+		return strings.TrimPrefix(u.Path, "/")
+	case "user":
+		if u.User != nil {
+			return u.User.Username()
+		}
+	case "password":
+		if u.User != nil {
+			password, _ := u.User.Password()
+			return password
+		}
+	}
+	return ""
+}
+
+// Environment variables libpq falls back to for connection parameters the DSN leaves unset
+var envParams = []struct{ env, key string }{
+	{"PGHOST", "host"},
+	{"PGPORT", "port"},
+	{"PGUSER", "user"},
+	{"PGPASSWORD", "password"},
+	{"PGDATABASE", "dbname"},
+	{"PGSSLMODE", "sslmode"},
+}
+
+// WithEnvDefaults returns the DSN with the parameters it leaves unset filled in from PGHOST,
+// PGPORT, PGUSER, PGPASSWORD, PGDATABASE, and PGSSLMODE, as libpq does. Parameters the DSN sets
+// always take precedence.
+func WithEnvDefaults(dsn string) (string, error) {
+	isSet, err := paramIsSet(dsn)
+	if err != nil {
+		return "", err
+	}
+
+	for _, param := range envParams {
+		value := os.Getenv(param.env)
+		if value == "" || isSet(param.key) {
+			continue
+		}
+		if dsn, err = SetParam(dsn, param.key, value); err != nil {
+			return "", err
+		}
+	}
+	return dsn, nil
+}
+
+// WithDefaultParam returns the DSN with a connection parameter set to value, unless the DSN
+// already sets it
+func WithDefaultParam(dsn, key, value string) (string, error) {
+	isSet, err := paramIsSet(dsn)
+	if err != nil {
+		return "", err
+	}
+	if isSet(key) {
+		return dsn, nil
+	}
+	return SetParam(dsn, key, value)
+}
+
+// paramIsSet returns a function reporting whether the DSN sets a connection parameter
+func paramIsSet(dsn string) (func(key string) bool, error) {
+	if !IsURIForm(dsn) {
+		params, err := parseKeywordDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return func(key string) bool { return params[key] != "" }, nil
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("invalid connection URI: %w", err)
+	}
+	query := u.Query()
+	return func(key string) bool { return uriParam(u, query, key) != "" }, nil
+}
+
+// Validate rejects a DSN that cannot name a server: an unparsable URI or keyword/value string,
+// a URI scheme other than postgres:// or postgresql://, or a URI without a host. A host given
+// as a query parameter, e.g. a Unix socket directory, or in PGHOST counts.
+func Validate(dsn string) error {
+	if scheme, _, ok := strings.Cut(dsn, "://"); ok && !IsURIForm(dsn) && !strings.ContainsAny(scheme, " =") {
+		return fmt.Errorf("unsupported scheme %q, expected postgres:// or postgresql://", scheme)
+	}
+	if !IsURIForm(dsn) {
+		_, err := parseKeywordDSN(dsn)
+		return err
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("invalid connection URI: %w", err)
+	}
+	if u.Hostname() == "" && u.Query().Get("host") == "" && os.Getenv("PGHOST") == "" {
+		return errors.New("connection URI has no host")
+	}
+	return nil
+}
+
+// parseKeywordComponents extracts URI components from a keyword/value DSN
+func parseKeywordComponents(dsn string) (Components, error) {
+	params, err := parseKeywordDSN(dsn)
+	if err != nil {
+		return Components{}, err
+	}
+
+	components := Components{
+		Host:   params["host"],
+		Port:   params["port"],
+		DBName: params["dbname"],
+		User:   params["user"],
+	}
+	if components.Port == "" {
+		components.Port = defaultPort
+	}
+
+	return components, nil
+}
+
+// parseKeywordDSN parses a libpq keyword/value connection string into a map. Values may be
+// single-quoted, with backslash escaping quotes and backslashes, as libpq allows.
+func parseKeywordDSN(dsn string) (map[string]string, error) {
+	params := make(map[string]string)
+	runes := []rune(dsn)
+	i := 0
+
+	skipSpaces := func() {
+		for i < len(runes) && (runes[i] == ' ' || runes[i] == '\t' || runes[i] == '\n') {
+			i++
+		}
+	}
+
+	for {
+		skipSpaces()
+		if i >= len(runes) {
+			return params, nil
+		}
+
+		// Read the keyword up to the equals sign
+		keyStart := i
+		for i < len(runes) && runes[i] != '=' && runes[i] != ' ' {
+			i++
+		}
+		key := string(runes[keyStart:i])
+		skipSpaces()
+		if i >= len(runes) || runes[i] != '=' || key == "" {
+			return nil, fmt.Errorf("invalid connection string: missing \"=\" after %q", key)
+		}
+		i++
+		skipSpaces()
+
+		// Read the value, honoring single quotes and backslash escapes
+		var value []rune
+		if i < len(runes) && runes[i] == '\'' {
+			i++
+			closed := false
+			for i < len(runes) {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					value = append(value, runes[i+1])
+					i += 2
+					continue
+				}
+				if runes[i] == '\'' {
+					closed = true
+					i++
+					break
+				}
+				value = append(value, runes[i])
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("invalid connection string: unterminated quoted value for %q", key)
+			}
+		} else {
+			for i < len(runes) && runes[i] != ' ' && runes[i] != '\t' && runes[i] != '\n' {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value = append(value, runes[i])
+				i++
+			}
+		}
+
+		params[key] = string(value)
+	}
+}
+
+// SetParam sets a connection parameter in either DSN form, overriding any existing value
+func SetParam(dsn, key, value string) (string, error) {
+	if !IsURIForm(dsn) {
+		// libpq applies the last occurrence of a keyword, so appending overrides it
+		escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+		return fmt.Sprintf("%s %s='%s'", strings.TrimSpace(dsn), key, escaped), nil
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return "", fmt.Errorf("invalid connection URI: %w", err)
+	}
+
+	query := u.Query()
+	query.Set(key, value)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// SetPassword sets the password in either DSN form. In a URI it goes in the userinfo, which
+// lib/pq prefers over a password query parameter, so any such parameter is removed.
+func SetPassword(dsn, password string) (string, error) {
+	if !IsURIForm(dsn) {
+		return SetParam(dsn, "password", password)
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return "", fmt.Errorf("invalid connection URI: %w", err)
+	}
+
+	query := u.Query()
+	if query.Has("password") {
+		query.Del("password")
+		u.RawQuery = query.Encode()
+	}
+	u.User = url.UserPassword(u.User.Username(), password)
+	return u.String(), nil
+}
+
+// WithDBName returns the DSN with its database replaced by dbName. PostgreSQL binds a
+// connection to its database at startup, so each database needs its own connection.
+func WithDBName(dsn, dbName string) (string, error) {
+	if !IsURIForm(dsn) {
+		return SetParam(dsn, "dbname", dbName)
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return "", fmt.Errorf("invalid connection URI: %w", err)
+	}
+
+	// A dbname query parameter would override the path
+	query := u.Query()
+	query.Del("dbname")
+	u.RawQuery = query.Encode()
+	u.Path = "/" + dbName
+	return u.String(), nil
+}
+
+// WithHost returns the DSN with its server replaced by hostPort, a host with an optional
+// port, which keeps the DSN's port when omitted
+func WithHost(dsn, hostPort string) (string, error) {
+	host, port := hostPort, ""
+	if h, p, err := net.SplitHostPort(hostPort); err == nil {
+		host, port = h, p
+	}
+
+	if !IsURIForm(dsn) {
+		dsn, err := SetParam(dsn, "host", host)
+		if err != nil || port == "" {
+			return dsn, err
+		}
+		return SetParam(dsn, "port", port)
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return "", fmt.Errorf("invalid connection URI: %w", err)
+	}
+
+	// Host and port query parameters would override the authority
+	query := u.Query()
+	if port == "" {
+		port = query.Get("port")
+		if port == "" {
+			port = u.Port()
+		}
+	}
+	query.Del("host")
+	query.Del("port")
+	u.RawQuery = query.Encode()
+	u.Host = host
+	if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	}
+	return u.String(), nil
+}
+
+// SplitHosts splits a URI listing several servers, as libpq accepts in
+// postgres://user@host1:5432,host2:5432/db, into the URI of the first server and the list of
+// all of them in order. Any other DSN is returned as is with no hosts.
+func SplitHosts(dsn string) (string, []string) {
+	if !IsURIForm(dsn) {
+		return dsn, nil
+	}
+	scheme, rest, _ := strings.Cut(dsn, "://")
+	end := strings.IndexAny(rest, "/?#")
+	if end < 0 {
+		end = len(rest)
+	}
+	authority := rest[:end]
+	userinfo := ""
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		userinfo, authority = authority[:at+1], authority[at+1:]
+	}
+	if !strings.Contains(authority, ",") {
+		return dsn, nil
+	}
+
+	var hosts []string
+	for _, host := range strings.Split(authority, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return dsn, nil
+	}
+	return scheme + "://" + userinfo + hosts[0] + rest[end:], hosts
+}
+
+// RenderTargetName executes a Go template such as "{{.Host}}/{{.DBName}}" over the parsed URI
+func RenderTargetName(nameTemplate string, pgURI string) (string, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid name template: %w", err)
+	}
+
+	components, err := ParseComponents(pgURI)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, components); err != nil {
+		return "", fmt.Errorf("failed to render name template: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// Matches a {{key}} placeholder, with optional spaces inside the braces
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// ExpandPlaceholders replaces each {{key}} placeholder in dsn with vars[key], as is. It fails on
+// a placeholder without a value and on any "{{" or "}}" left over, such as a malformed
+// placeholder, naming only the placeholders so the error cannot leak the password.
+func ExpandPlaceholders(dsn string, vars map[string]string) (string, error) {
+	var missing []string
+	expanded := placeholderPattern.ReplaceAllStringFunc(dsn, func(placeholder string) string {
+		key := placeholderPattern.FindStringSubmatch(placeholder)[1]
+		value, ok := vars[key]
+		if !ok {
+			missing = append(missing, "{{"+key+"}}")
+			return placeholder
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("no -var value for %s", strings.Join(missing, ", "))
+	}
+	// Check the template, not the result, so braces in a substituted value are allowed
+	if leftover := placeholderPattern.ReplaceAllString(dsn, ""); strings.Contains(leftover, "{{") || strings.Contains(leftover, "}}") {
+		return "", errors.New("malformed placeholder: expected {{key}} with a key of letters, digits, and underscores")
+	}
+	return expanded, nil
+}
+
+// Replacement for passwords in logged URIs and errors
+const redactedPassword = "xxxxx"
+
+var (
+	// Matches the password in a keyword/value DSN, quoted or not
+	keywordPasswordPattern = regexp.MustCompile(`(?i)(\bpassword\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+	// Matches the password in userinfo, for URIs url.Parse rejects
+	userinfoPasswordPattern = regexp.MustCompile(`(://[^:/@]*:)[^@]*@`)
+)
+
+// Redact returns the URI or keyword/value DSN with its password replaced by xxxxx
+func Redact(dsn string) string {
+	if !IsURIForm(dsn) {
+		// Another scheme's URI, e.g. a mistyped one, can still carry userinfo
+		if strings.Contains(dsn, "://") {
+			return userinfoPasswordPattern.ReplaceAllString(dsn, "${1}"+redactedPassword+"@")
+		}
+		return keywordPasswordPattern.ReplaceAllString(dsn, "${1}"+redactedPassword)
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return userinfoPasswordPattern.ReplaceAllString(dsn, "${1}"+redactedPassword+"@")
+	}
+	query := u.Query()
+	if query.Has("password") {
+		query.Set("password", redactedPassword)
+		u.RawQuery = query.Encode()
+	}
+	return u.Redacted()
+}
+
+// passwordOf returns the password in a URI or keyword/value DSN, or "" if there is none
+func passwordOf(dsn string) string {
+	if !IsURIForm(dsn) {
+		params, err := parseKeywordDSN(dsn)
+		if err != nil {
+			return ""
+		}
+		return params["password"]
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return ""
+	}
+	if password := u.Query().Get("password"); password != "" {
+		return password
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		return password
+	}
+	return ""
+}
+
+// RedactError returns the error message with any of the DSNs, and their passwords, masked.
+// Driver errors can echo the DSN back, so use it wherever a connection error is logged.
+func RedactError(err error, dsns ...string) string {
+	if err == nil {
+		return ""
+	}
+
+	msg := err.Error()
+	for _, dsn := range dsns {
+		if dsn == "" {
+			continue
+		}
+		msg = strings.ReplaceAll(msg, dsn, Redact(dsn))
+		if password := passwordOf(dsn); password != "" {
+			msg = strings.ReplaceAll(msg, password, redactedPassword)
+		}
+	}
+	return msg
+}
@@ -0,0 +1,72 @@
+package conntester
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/chalk/conntester/internal/dsn"
+)
+
+// KeepaliveResult is the outcome of one keepalive cycle
+type KeepaliveResult struct {
+	// Whether the connection answered the test query after idling
+	Survived bool
+	// Time from opening the connection to the test query succeeding or failing
+	Age time.Duration
+	// Test query latency after the idle period
+	QueryLatency time.Duration
+}
+
+// Keepalive opens a connection, leaves it idle for idle, and then runs the test query on it,
+// to catch firewalls and NAT gateways that silently drop idle connections, which an attempt
+// that connects anew never sees. It emits IdleSurvivedMetric as 1 or 0, and on failure the
+// connection's age as IdleFailureAgeMetric. The returned error is the query's, or the
+// connection's if it could not be opened, in which case no metrics are emitted.
+func (t *Tester) Keepalive(ctx context.Context, idle time.Duration) (KeepaliveResult, error) {
+	opts := t.Options.withDefaults(t.Timeout)
+
+	db, err := openDB(opts.Driver, t.URI, opts.TLSServerName, nil, nil, opts.SourceAddr, opts.Proxy)
+	if err != nil {
+		return KeepaliveResult{}, err
+	}
+	defer db.Close()
+
+	// Pin one connection, so the query runs on the connection that idled rather than a new one
+	connectCtx, cancel := context.WithTimeout(ctx, t.Timeout)
+	defer cancel()
+	conn, err := db.Conn(connectCtx)
+	if err == nil {
+		err = conn.PingContext(connectCtx)
+	}
+	if err != nil {
+		return KeepaliveResult{}, fmt.Errorf("failed to open connection: %w", err)
+	}
+	defer conn.Close()
+	opened := time.Now()
+
+	if !sleepContext(ctx, idle) {
+		return KeepaliveResult{}, ctx.Err()
+	}
+
+	queryCtx, queryCancel := context.WithTimeout(ctx, opts.QueryTimeout)
+	defer queryCancel()
+	queryStart := time.Now()
+	_, _, err = queryFirstColumn(queryCtx, conn, opts.Query)
+	result := KeepaliveResult{Survived: err == nil, Age: time.Since(opened), QueryLatency: time.Since(queryStart)}
+
+	survived := 0.0
+	if result.Survived {
+		survived = 1
+	}
+	if emitErr := t.Backend.Gauge(IdleSurvivedMetric, survived, t.Tags); emitErr != nil {
+		t.logf("Failed to emit idle survived metric: %v", emitErr)
+	}
+	if !result.Survived {
+		t.logf("Idle connection failed after %v: %s", result.Age.Round(time.Millisecond), dsn.RedactError(err, t.URI))
+		if emitErr := t.Backend.RecordLatency(IdleFailureAgeMetric, result.Age, t.Tags); emitErr != nil {
+			t.logf("Failed to emit idle failure age metric: %v", emitErr)
+		}
+	}
+	return result, err
+}
@@ -0,0 +1,152 @@
+package conntester
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// Default OTLP/HTTP path metrics are exported to when the endpoint URL has no path
+const otlpMetricsPath = "/v1/metrics"
+
+// OTLPBackend exports metrics to an OpenTelemetry collector over OTLP/HTTP. Metric names are
+// kept as they are for StatsD, latencies are histograms in seconds, and tags become attributes.
+// The API gives no control over the time of a data point, so a TimestampTag is kept as an
+// attribute, which exports every attempt as its own data point.
+type OTLPBackend struct {
+	provider *sdkmetric.MeterProvider
+	meter    metric.Meter
+
+	mu         sync.Mutex
+	histograms map[string]metric.Float64Histogram
+	counters   map[string]metric.Int64Counter
+	gauges     map[string]metric.Float64Gauge
+}
+
+// NewOTLPBackend returns a Backend exporting to the OTLP/HTTP endpoint URL, e.g.
+// http://collector:4318. The standard OTEL_* environment variables still apply to the resource.
+func NewOTLPBackend(ctx context.Context, endpoint string) (*OTLPBackend, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("OTLP endpoint must be an http:// or https:// URL, got %q", endpoint)
+	}
+	if strings.TrimSuffix(u.Path, "/") == "" {
+		u.Path = otlpMetricsPath
+	}
+
+	exporter, err := otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "conntester")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)),
+		sdkmetric.WithResource(res),
+	)
+	return &OTLPBackend{
+		provider:   provider,
+		meter:      provider.Meter("github.com/chalk/conntester"),
+		histograms: make(map[string]metric.Float64Histogram),
+		counters:   make(map[string]metric.Int64Counter),
+		gauges:     make(map[string]metric.Float64Gauge),
+	}, nil
+}
+
+func (b *OTLPBackend) RecordLatency(name string, latency time.Duration, tags []string) error {
+	b.mu.Lock()
+	histogram, ok := b.histograms[name]
+	if !ok {
+		var err error
+		histogram, err = b.meter.Float64Histogram(name, metric.WithUnit("s"), metric.WithExplicitBucketBoundaries(latencyBuckets...))
+		if err != nil {
+			b.mu.Unlock()
+			return err
+		}
+		b.histograms[name] = histogram
+	}
+	b.mu.Unlock()
+
+	histogram.Record(context.Background(), latency.Seconds(), metric.WithAttributes(otelAttributes(tags)...))
+	return nil
+}
+
+func (b *OTLPBackend) Count(name string, value int64, tags []string) error {
+	b.mu.Lock()
+	counter, ok := b.counters[name]
+	if !ok {
+		var err error
+		counter, err = b.meter.Int64Counter(name)
+		if err != nil {
+			b.mu.Unlock()
+			return err
+		}
+		b.counters[name] = counter
+	}
+	b.mu.Unlock()
+
+	counter.Add(context.Background(), value, metric.WithAttributes(otelAttributes(tags)...))
+	return nil
+}
+
+func (b *OTLPBackend) Gauge(name string, value float64, tags []string) error {
+	b.mu.Lock()
+	gauge, ok := b.gauges[name]
+	if !ok {
+		var err error
+		gauge, err = b.meter.Float64Gauge(name)
+		if err != nil {
+			b.mu.Unlock()
+			return err
+		}
+		b.gauges[name] = gauge
+	}
+	b.mu.Unlock()
+
+	gauge.Record(context.Background(), value, metric.WithAttributes(otelAttributes(tags)...))
+	return nil
+}
+
+// RecoveryEvent is a no-op: OTLP metrics have no events, and the outage duration is recorded as a histogram
+func (b *OTLPBackend) RecoveryEvent(title, text string, tags []string) error {
+	return nil
+}
+
+// Flush exports everything recorded so far
+func (b *OTLPBackend) Flush() error {
+	return b.provider.ForceFlush(context.Background())
+}
+
+// Close flushes and shuts down the meter provider
+func (b *OTLPBackend) Close() error {
+	return b.provider.Shutdown(context.Background())
+}
+
+// otelAttributes converts k:v tags to string attributes. Tags without a value are dropped.
+func otelAttributes(tags []string) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(tags))
+	for _, tag := range tags {
+		key, value, ok := strings.Cut(tag, ":")
+		if !ok || key == "" {
+			continue
+		}
+		attrs = append(attrs, attribute.String(key, value))
+	}
+	return attrs
+}
@@ -0,0 +1,195 @@
+package conntester
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// PersistentConn is a connection kept open across attempts for Options.Persistent, so each
+// attempt only pings and queries it instead of connecting anew, as a long-lived application
+// connection would. The zero value has no connection open. Not safe for concurrent use.
+type PersistentConn struct {
+	db   *sql.DB
+	conn *sql.Conn
+	// Major server version read over the connection, empty until Options.DetectVersion reads it
+	version string
+	// URI with the password last read from Options.CredentialFile, empty until it is re-read.
+	// It outlives the connection, so later reconnects use the new password.
+	uri string
+	// The connection was closed after a failed attempt for Options.ReconnectOnError, so the next
+	// attempt reconnects and is tagged reconnected:true
+	reconnected bool
+	// Server process ID the last attempt reached, zero until one is read. It outlives the
+	// connection, so a reconnect is tagged conn_reused:false.
+	pid int
+	// Connection latency of the first attempt, which connected cold, zero until one succeeds
+	cold time.Duration
+	// Total and number of the connection latencies of the attempts that reused the connection warm
+	warmTotal time.Duration
+	warmCount int
+	// Connections the pool had closed for exceeding their idle time and lifetime as of the last
+	// attempt, reset with the pool
+	idleTimeClosed, lifetimeClosed int64
+}
+
+// pin takes a single connection from db, closing db on failure, and keeps both for later attempts.
+// A pinned *sql.Conn is never silently replaced by the pool, so a lost connection surfaces as an error.
+func (p *PersistentConn) pin(ctx context.Context, db *sql.DB) (*sql.Conn, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	p.db, p.conn = db, conn
+	return conn, nil
+}
+
+// Prewarm opens n connections to the server at once, with concurrent pings, into the pool of
+// the tester's Persistent connection, and pins one of them unless a connection is already
+// pinned, so the first attempt reuses a warm connection instead of connecting. The pool keeps
+// all n open. It returns how long opening them took.
+func (t *Tester) Prewarm(ctx context.Context, n int) (time.Duration, error) {
+	p := t.Options.Persistent
+	if p == nil {
+		return 0, errors.New("prewarming requires a persistent connection")
+	}
+	opts := t.Options.withDefaults(t.Timeout)
+	ctx, cancel := context.WithTimeout(ctx, t.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	pool := p.db
+	if pool == nil {
+		uri := t.URI
+		if p.uri != "" {
+			uri = p.uri
+		}
+		var err error
+		if pool, err = openDB(opts.Driver, uri, opts.TLSServerName, nil, nil, opts.SourceAddr, opts.Proxy); err != nil {
+			return 0, err
+		}
+	}
+	pool.SetMaxIdleConns(n)
+
+	// Hold every connection until all are open, so the pool cannot hand one out twice
+	conns := make([]*sql.Conn, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if conns[i], errs[i] = pool.Conn(ctx); errs[i] == nil {
+				errs[i] = conns[i].PingContext(ctx)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	for _, conn := range conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			if p.db == nil {
+				pool.Close()
+			}
+			return elapsed, err
+		}
+	}
+
+	if p.db == nil {
+		if _, err := p.pin(ctx, pool); err != nil {
+			return elapsed, err
+		}
+	}
+	return elapsed, nil
+}
+
+// Close closes the connection, if one is open. The next attempt opens a new one.
+func (p *PersistentConn) Close() error {
+	if p.db == nil {
+		return nil
+	}
+	p.conn.Close()
+	err := p.db.Close()
+	p.db, p.conn, p.version = nil, nil, ""
+	p.idleTimeClosed, p.lifetimeClosed = 0, 0
+	return err
+}
+
+// observeLatency records a successful attempt's connection latency, warm if it reused the
+// connection, and returns how much slower the first, cold attempt was than the average warm
+// one, once there are both
+func (p *PersistentConn) observeLatency(latency time.Duration, warm bool) (time.Duration, bool) {
+	if warm {
+		p.warmTotal += latency
+		p.warmCount++
+	} else if p.cold == 0 {
+		p.cold = latency
+	}
+	if p.cold == 0 || p.warmCount == 0 {
+		return 0, false
+	}
+	return p.cold - p.warmTotal/time.Duration(p.warmCount), true
+}
+
+// reportStats emits the statistics of the pool the connection is kept in as gauges, and the
+// connections it closed since the last attempt as counts, if one is open. It returns the number
+// of metric emissions that failed.
+func (p *PersistentConn) reportStats(client Backend, customTags []string) int {
+	if p.db == nil {
+		return 0
+	}
+
+	failed := 0
+	stats := p.db.Stats()
+	for _, gauge := range poolGauges(stats) {
+		if err := client.Gauge(gauge.name, gauge.value, customTags); err != nil {
+			log.Printf("Failed to emit %s metric: %v", gauge.name, err)
+			failed++
+		}
+	}
+
+	// The pool's counts are cumulative, so count what was closed since the last attempt
+	closedCounts := []struct {
+		name  string
+		total int64
+		last  *int64
+	}{
+		{PoolMaxIdleTimeClosedMetric, stats.MaxIdleTimeClosed, &p.idleTimeClosed},
+		{PoolMaxLifetimeClosedMetric, stats.MaxLifetimeClosed, &p.lifetimeClosed},
+	}
+	for _, closed := range closedCounts {
+		if err := client.Count(closed.name, closed.total-*closed.last, customTags); err != nil {
+			log.Printf("Failed to emit %s metric: %v", closed.name, err)
+			failed++
+		}
+		*closed.last = closed.total
+	}
+	return failed
+}
+
+// poolGauge is one pool statistic emitted by reportStats
+type poolGauge struct {
+	name  string
+	value float64
+}
+
+// poolGauges returns the gauges reportStats emits for stats
+func poolGauges(stats sql.DBStats) []poolGauge {
+	return []poolGauge{
+		{PoolOpenConnsMetric, float64(stats.OpenConnections)},
+		{PoolInUseMetric, float64(stats.InUse)},
+		{PoolIdleMetric, float64(stats.Idle)},
+		{PoolWaitCountMetric, float64(stats.WaitCount)},
+		{PoolWaitDurationMetric, stats.WaitDuration.Seconds()},
+		{PoolMaxIdleClosedMetric, float64(stats.MaxIdleClosed)},
+	}
+}
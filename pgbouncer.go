@@ -0,0 +1,136 @@
+package conntester
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/chalk/conntester/internal/dsn"
+)
+
+// PgBouncerMetricPrefix starts the names of the gauges read from the PgBouncer admin console,
+// e.g. chalk.conntester.pgbouncer.cl_active
+const PgBouncerMetricPrefix = MetricStem + ".pgbouncer."
+
+// Admin console commands and the columns of each that are emitted as gauges. Columns missing
+// from the running PgBouncer version are skipped.
+var pgBouncerCommands = []struct {
+	command string
+	columns []string
+}{
+	{"SHOW POOLS", []string{"cl_active", "cl_waiting", "sv_active", "sv_idle", "maxwait"}},
+	{"SHOW STATS", []string{"total_xact_count", "total_query_count", "avg_xact_time", "avg_query_time", "avg_wait_time"}},
+}
+
+// reportPgBouncer reads the target database's pools and stats from the PgBouncer admin
+// console, the pgbouncer database on the same host and port, and emits them as gauges.
+// A target that is not PgBouncer is only logged. It returns the number of failed emissions.
+func (t *Tester) reportPgBouncer(ctx context.Context, client Backend, customTags []string) int {
+	opts := t.Options
+	components, err := dsn.ParseComponents(t.URI)
+	if err != nil {
+		t.logf("Failed to read PgBouncer stats: %v", err)
+		return 0
+	}
+	// As in libpq, the database defaults to the user name
+	database := components.DBName
+	if database == "" {
+		database = components.User
+	}
+
+	adminURI, err := dsn.WithDBName(t.URI, "pgbouncer")
+	if err != nil {
+		t.logf("Failed to read PgBouncer stats: %v", err)
+		return 0
+	}
+	admin, err := openDB(opts.Driver, adminURI, opts.TLSServerName, nil, nil, opts.SourceAddr, opts.Proxy)
+	if err != nil {
+		t.logf("Failed to read PgBouncer stats: %s", dsn.RedactError(err, adminURI))
+		return 0
+	}
+	defer admin.Close()
+
+	values := make(map[string]float64)
+	for _, show := range pgBouncerCommands {
+		if err := readPgBouncerShow(ctx, admin, show.command, database, show.columns, values); err != nil {
+			t.logf("Failed to read PgBouncer stats, the target may not be PgBouncer: %s: %s", show.command, dsn.RedactError(err, adminURI))
+			return 0
+		}
+	}
+
+	emitErrors := 0
+	for _, show := range pgBouncerCommands {
+		for _, column := range show.columns {
+			value, ok := values[column]
+			if !ok {
+				continue
+			}
+			if err := client.Gauge(PgBouncerMetricPrefix+column, value, customTags); err != nil {
+				t.logf("Failed to emit PgBouncer %s metric: %v", column, err)
+				emitErrors++
+			}
+		}
+	}
+	return emitErrors
+}
+
+// readPgBouncerShow runs an admin console SHOW command and adds the wanted columns of the
+// database's rows to values. The console only speaks the simple query protocol and its column
+// set varies by version, so every column is scanned as text and picked out by name.
+func readPgBouncerShow(ctx context.Context, db *sql.DB, command, database string, columns []string, values map[string]float64) error {
+	rows, err := db.QueryContext(ctx, command)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	names, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	databaseIndex := slices.Index(names, "database")
+	if databaseIndex < 0 {
+		return fmt.Errorf("no database column")
+	}
+
+	found := false
+	for rows.Next() {
+		row := make([]sql.NullString, len(names))
+		dest := make([]any, len(names))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		if row[databaseIndex].String != database {
+			continue
+		}
+		found = true
+
+		for i, name := range names {
+			if !slices.Contains(columns, name) || !row[i].Valid {
+				continue
+			}
+			value, err := strconv.ParseFloat(row[i].String, 64)
+			if err != nil {
+				return fmt.Errorf("column %s: %w", name, err)
+			}
+			// A database has a pool per user: the wait is the longest, the rest add up
+			if name == "maxwait" {
+				values[name] = max(values[name], value)
+			} else {
+				values[name] += value
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no rows for database %q", database)
+	}
+	return nil
+}
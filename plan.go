@@ -0,0 +1,81 @@
+package conntester
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// ChangeTracker remembers a hash across attempts to report when it changes, e.g. the test
+// query's plan for Options.Plans. It is safe for concurrent use.
+type ChangeTracker struct {
+	mu sync.Mutex
+	// Hash the next one is compared with, empty until the first is observed
+	baseline string
+	// Move the baseline to every new hash, so only changes between consecutive attempts are reported
+	follow bool
+}
+
+// NewChangeTracker returns a tracker comparing every hash with baseline, or with the first hash
+// observed if baseline is empty. With follow, each hash becomes the baseline of the next.
+func NewChangeTracker(baseline string, follow bool) *ChangeTracker {
+	return &ChangeTracker{baseline: baseline, follow: follow}
+}
+
+// observe records hash and returns the baseline it was compared with and whether it differs
+func (c *ChangeTracker) observe(hash string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	baseline := c.baseline
+	if baseline == "" || c.follow {
+		c.baseline = hash
+	}
+	return baseline, baseline != "" && hash != baseline
+}
+
+// explainPlan runs EXPLAIN (FORMAT JSON) on query and returns a short hash of the plan's shape.
+// The planner's estimates, every numeric field such as costs and row counts, are left out of the
+// hash so it only changes when the plan does, e.g. when a sequential scan replaces an index scan.
+func explainPlan(ctx context.Context, db querier, query string) (string, error) {
+	var plan string
+	if err := db.QueryRowContext(ctx, "EXPLAIN (FORMAT JSON) "+query).Scan(&plan); err != nil {
+		return "", err
+	}
+	var parsed any
+	if err := json.Unmarshal([]byte(plan), &parsed); err != nil {
+		return "", fmt.Errorf("failed to parse the plan: %w", err)
+	}
+
+	// Marshaling sorts the object keys, so equal shapes hash equally
+	shape, err := json.Marshal(planShape(parsed))
+	if err != nil {
+		return "", err
+	}
+	h := fnv.New32a()
+	h.Write(shape)
+	return fmt.Sprintf("%08x", h.Sum32()), nil
+}
+
+// planShape returns a parsed JSON plan without its numeric fields
+func planShape(node any) any {
+	switch v := node.(type) {
+	case map[string]any:
+		shape := make(map[string]any, len(v))
+		for key, value := range v {
+			if _, numeric := value.(float64); !numeric {
+				shape[key] = planShape(value)
+			}
+		}
+		return shape
+	case []any:
+		shape := make([]any, len(v))
+		for i, value := range v {
+			shape[i] = planShape(value)
+		}
+		return shape
+	default:
+		return v
+	}
+}
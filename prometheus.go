@@ -0,0 +1,270 @@
+package conntester
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds in seconds of the histogram buckets latencies are recorded in
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Characters not allowed in Prometheus metric and label names
+var invalidPromNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// Escapes the characters the text format does not allow unescaped in label values
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// PrometheusBackend accumulates metrics in memory and, on every Flush, writes them in the
+// Prometheus text format to a node_exporter textfile and/or pushes them to a Pushgateway.
+// It also serves them over HTTP for scraping.
+// Counters and histograms are cumulative over the life of the process, as Prometheus expects.
+// A TimestampTag becomes the timestamp of the series' samples on /metrics, and is left out of
+// the textfile and the push, which the textfile collector and the Pushgateway reject.
+type PrometheusBackend struct {
+	// Path of the .prom file written on Flush, empty to skip
+	textfile string
+	// Pushgateway group URL the metrics are PUT to on Flush, empty to skip
+	pushURL string
+	http    http.Client
+
+	mu     sync.Mutex
+	series map[string]*promSeries
+}
+
+// promSeries is one metric with one label set
+type promSeries struct {
+	name   string
+	kind   string
+	labels string
+
+	value float64
+	// Start of the latest attempt recorded in the series from its TimestampTag, zero if untagged
+	timestamp time.Time
+	// Cumulative count per latencyBuckets bound, for histograms
+	buckets []uint64
+	count   uint64
+}
+
+// NewPrometheusBackend returns a Backend that writes textfile and/or pushes to the Pushgateway at
+// pushgatewayURL under job. At least one of textfile and pushgatewayURL should be set.
+func NewPrometheusBackend(textfile, pushgatewayURL, job string) *PrometheusBackend {
+	b := &PrometheusBackend{
+		textfile: textfile,
+		http:     http.Client{Timeout: 5 * time.Second},
+		series:   make(map[string]*promSeries),
+	}
+	if pushgatewayURL != "" {
+		b.pushURL = strings.TrimSuffix(pushgatewayURL, "/") + "/metrics/job/" + url.PathEscape(job)
+	}
+	return b
+}
+
+// RecordLatency observes the latency in a histogram named <name>_seconds
+func (b *PrometheusBackend) RecordLatency(name string, latency time.Duration, tags []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := b.get(promName(name)+"_seconds", "histogram", tags)
+	seconds := latency.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += seconds
+	return nil
+}
+
+// Count adds to a counter named <name>_total
+func (b *PrometheusBackend) Count(name string, value int64, tags []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.get(promName(name)+"_total", "counter", tags).value += float64(value)
+	return nil
+}
+
+func (b *PrometheusBackend) Gauge(name string, value float64, tags []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.get(promName(name), "gauge", tags).value = value
+	return nil
+}
+
+// RecoveryEvent is a no-op: Prometheus has no events, and the outage duration is recorded as a histogram
+func (b *PrometheusBackend) RecoveryEvent(title, text string, tags []string) error {
+	return nil
+}
+
+// Flush writes the textfile and pushes to the Pushgateway, returning the first error
+func (b *PrometheusBackend) Flush() error {
+	b.mu.Lock()
+	body := b.render(false)
+	b.mu.Unlock()
+
+	var firstErr error
+	if b.textfile != "" {
+		// Write then rename so the textfile collector never reads a partial file
+		tmp := b.textfile + ".tmp"
+		err := os.WriteFile(tmp, body, 0o644)
+		if err == nil {
+			err = os.Rename(tmp, b.textfile)
+		}
+		if err != nil {
+			firstErr = fmt.Errorf("failed to write Prometheus textfile: %w", err)
+		}
+	}
+	if b.pushURL != "" {
+		if err := b.push(body); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (b *PrometheusBackend) Close() error {
+	return b.Flush()
+}
+
+// ServeHTTP serves the current metrics in the text format, for scraping
+func (b *PrometheusBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	body := b.render(true)
+	b.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(body)
+}
+
+// push replaces the job's metrics on the Pushgateway
+func (b *PrometheusBackend) push(body []byte) error {
+	req, err := http.NewRequest(http.MethodPut, b.pushURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to push to Pushgateway: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Pushgateway returned %s", resp.Status)
+	}
+	return nil
+}
+
+// get returns the series for name and tags, creating it if needed. The caller holds b.mu.
+func (b *PrometheusBackend) get(name, kind string, tags []string) *promSeries {
+	labels := promLabels(tags)
+	key := name + "{" + labels + "}"
+	s, ok := b.series[key]
+	if !ok {
+		s = &promSeries{name: name, kind: kind, labels: labels}
+		if kind == "histogram" {
+			s.buckets = make([]uint64, len(latencyBuckets))
+		}
+		b.series[key] = s
+	}
+	for _, tag := range tags {
+		if value, ok := strings.CutPrefix(tag, TimestampTag+":"); ok {
+			if micros, err := strconv.ParseInt(value, 10, 64); err == nil {
+				s.timestamp = time.UnixMicro(micros)
+			}
+		}
+	}
+	return s
+}
+
+// render formats every series in the text exposition format, grouped by metric name, with the
+// sample timestamps of tagged series if timestamps is set. The caller holds b.mu.
+func (b *PrometheusBackend) render(timestamps bool) []byte {
+	series := make([]*promSeries, 0, len(b.series))
+	for _, s := range b.series {
+		series = append(series, s)
+	}
+	slices.SortFunc(series, func(x, y *promSeries) int {
+		return strings.Compare(x.name+"{"+x.labels, y.name+"{"+y.labels)
+	})
+
+	var buf bytes.Buffer
+	for i, s := range series {
+		if i == 0 || series[i-1].name != s.name {
+			fmt.Fprintf(&buf, "# TYPE %s %s\n", s.name, s.kind)
+		}
+		// The text format's timestamps are in milliseconds
+		timestamp := ""
+		if timestamps && !s.timestamp.IsZero() {
+			timestamp = " " + strconv.FormatInt(s.timestamp.UnixMilli(), 10)
+		}
+		if s.kind != "histogram" {
+			fmt.Fprintf(&buf, "%s%s %g%s\n", s.name, braced(s.labels), s.value, timestamp)
+			continue
+		}
+		for j, bound := range latencyBuckets {
+			fmt.Fprintf(&buf, "%s_bucket%s %d%s\n", s.name, braced(joinLabels(s.labels, fmt.Sprintf(`le="%g"`, bound))), s.buckets[j], timestamp)
+		}
+		fmt.Fprintf(&buf, "%s_bucket%s %d%s\n", s.name, braced(joinLabels(s.labels, `le="+Inf"`)), s.count, timestamp)
+		fmt.Fprintf(&buf, "%s_sum%s %g%s\n", s.name, braced(s.labels), s.value, timestamp)
+		fmt.Fprintf(&buf, "%s_count%s %d%s\n", s.name, braced(s.labels), s.count, timestamp)
+	}
+	return buf.Bytes()
+}
+
+// promName converts a StatsD metric name such as chalk.conntester.duration to chalk_conntester_duration
+func promName(name string) string {
+	return invalidPromNameChars.ReplaceAllString(name, "_")
+}
+
+// promLabels converts k:v tags to a sorted, comma-separated Prometheus label list. Tags without
+// a value and the TimestampTag are dropped, and a repeated key keeps its last value.
+func promLabels(tags []string) string {
+	values := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		key, value, ok := strings.Cut(tag, ":")
+		if !ok || key == "" || key == TimestampTag {
+			continue
+		}
+		values[promName(key)] = value
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, key, labelValueEscaper.Replace(values[key]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// joinLabels appends a label to a label list
+func joinLabels(labels, label string) string {
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+// braced wraps a non-empty label list in braces
+func braced(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
@@ -0,0 +1,501 @@
+package conntester
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// querier is what the probe queries through: a *sql.DB, or the *sql.Conn of a PersistentConn
+type querier interface {
+	PingContext(ctx context.Context) error
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// rowQuerier runs queries returning rows: a querier, or a *sql.Tx
+type rowQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// errResultTooLarge is returned by the query readers once the rows read exceed Options.MaxResultBytes
+var errResultTooLarge = errors.New("test query result exceeds the maximum size")
+
+// byteBudget totals the size of the rows a query reader has read against a maximum
+type byteBudget struct {
+	// Most bytes to read, 0 for no limit
+	max  int
+	used int
+}
+
+// add counts n more bytes read, returning errResultTooLarge once the total exceeds the maximum
+func (b *byteBudget) add(n int) error {
+	b.used += n
+	if b.max > 0 && b.used > b.max {
+		return errResultTooLarge
+	}
+	return nil
+}
+
+// scan scans the current row's columns as raw bytes and adds their size, doing nothing
+// without a maximum so rows that are only counted are not scanned
+func (b *byteBudget) scan(rows *sql.Rows) error {
+	if b.max <= 0 {
+		return nil
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return err
+	}
+	for _, value := range values {
+		if err := b.add(len(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runStreamingQuery reads every row returned by query, cancelling it if any single
+// row takes longer than rowTimeout to arrive or the rows exceed the budget. It reports
+// the number of rows read and whether a row stalled.
+func runStreamingQuery(ctx context.Context, db rowQuerier, query string, rowTimeout time.Duration, budget *byteBudget) (int, bool, error) {
+	queryCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var stalled atomic.Bool
+	timer := time.AfterFunc(rowTimeout, func() {
+		stalled.Store(true)
+		cancel()
+	})
+	defer timer.Stop()
+
+	rows, err := db.QueryContext(queryCtx, query)
+	if err != nil {
+		return 0, stalled.Load(), err
+	}
+	defer rows.Close()
+
+	rowCount := 0
+	for {
+		timer.Reset(rowTimeout)
+		if !rows.Next() {
+			break
+		}
+		rowCount++
+		if err := budget.scan(rows); err != nil {
+			// Closing the rows alone would read the rest of the result, so cancel the query first
+			timer.Stop()
+			cancel()
+			return rowCount, false, err
+		}
+	}
+	timer.Stop()
+
+	// A stall cancels the query, so the resulting context error is expected
+	if stalled.Load() {
+		return rowCount, true, nil
+	}
+	return rowCount, false, rows.Err()
+}
+
+// queryFirstColumn runs query and returns the first column of its first row, scanned into a
+// generic holder so arbitrary result types work, and how long the first row took to arrive
+// (zero if none did). Further columns and rows are ignored. A statement that returns no
+// columns, such as an INSERT without RETURNING, succeeds with a nil value.
+func queryFirstColumn(ctx context.Context, db rowQuerier, query string) (any, time.Duration, error) {
+	start := time.Now()
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	// The columns are only available until the rows are exhausted
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, 0, err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, 0, err
+		}
+		if len(columns) == 0 {
+			return nil, 0, nil
+		}
+		return nil, 0, sql.ErrNoRows
+	}
+	firstRow := time.Since(start)
+	if len(columns) == 0 {
+		return nil, firstRow, nil
+	}
+
+	// Scan needs a destination per column, so discard everything after the first
+	var first any
+	dest := make([]any, len(columns))
+	dest[0] = &first
+	for i := 1; i < len(dest); i++ {
+		dest[i] = new(any)
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, firstRow, err
+	}
+	return first, firstRow, nil
+}
+
+// expectOperators are the comparisons an Options.Expect value may start with, the two-character
+// ones first so >= is not read as >
+var expectOperators = []string{">=", "<=", "!=", ">", "<", "~"}
+
+// splitExpect splits an Options.Expect value into its operator, empty for equality, and operand
+func splitExpect(expected string) (string, string) {
+	for _, op := range expectOperators {
+		if operand, ok := strings.CutPrefix(expected, op); ok {
+			if op != "~" {
+				operand = strings.TrimSpace(operand)
+			}
+			return op, operand
+		}
+	}
+	return "", expected
+}
+
+// CheckExpect returns an error if the Options.Expect value cannot be checked: a ~ comparison
+// whose regular expression does not compile
+func CheckExpect(expected string) error {
+	if op, operand := splitExpect(expected); op == "~" {
+		if _, err := regexp.Compile(operand); err != nil {
+			return fmt.Errorf("invalid regular expression: %w", err)
+		}
+	}
+	return nil
+}
+
+// matchesExpected reports whether a value scanned by queryFirstColumn satisfies expected: equals
+// it, or with an operator, compares to the operand as the operator says. >, <, >=, and <=
+// compare numerically when both sides are numbers and as strings otherwise, and never match
+// NULL; ~ matches a regular expression against the value as formatValue formats it.
+func matchesExpected(value any, expected string) bool {
+	op, operand := splitExpect(expected)
+	switch op {
+	case "":
+		return equalsExpected(value, operand)
+	case "!=":
+		return !equalsExpected(value, operand)
+	case "~":
+		pattern, err := regexp.Compile(operand)
+		return err == nil && pattern.MatchString(formatValue(value))
+	}
+	if value == nil {
+		return false
+	}
+
+	actual := formatValue(value)
+	order := strings.Compare(actual, operand)
+	if a, err := strconv.ParseFloat(actual, 64); err == nil {
+		if b, err := strconv.ParseFloat(operand, 64); err == nil {
+			order = cmp.Compare(a, b)
+		}
+	}
+	switch op {
+	case ">":
+		return order > 0
+	case "<":
+		return order < 0
+	case ">=":
+		return order >= 0
+	default:
+		return order <= 0
+	}
+}
+
+// equalsExpected reports whether a value scanned by queryFirstColumn equals expected. Booleans
+// also match PostgreSQL's t and f, so either the Go or the psql spelling can be expected.
+func equalsExpected(value any, expected string) bool {
+	if b, ok := value.(bool); ok {
+		parsed, err := strconv.ParseBool(expected)
+		return err == nil && parsed == b
+	}
+	return formatValue(value) == expected
+}
+
+// formatValue formats a value scanned by queryFirstColumn as a string: text as is, NULL as
+// "NULL", booleans as true or false, and timestamps in RFC 3339
+func formatValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// countRows runs query and returns how many rows it produced, unlike QueryRow
+// which silently discards any rows after the first. With a limit above 0, counting
+// stops at limit rows and the rest of the result is cancelled rather than read, as
+// it is once the rows exceed the budget.
+func countRows(ctx context.Context, db rowQuerier, query string, limit int, budget *byteBudget) (int, error) {
+	queryCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(queryCtx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	rowCount := 0
+	for rows.Next() {
+		rowCount++
+		if err := budget.scan(rows); err != nil {
+			cancel()
+			return rowCount, err
+		}
+		if rowCount == limit {
+			// Closing the rows alone would read the rest of the result, so cancel the query first
+			cancel()
+			return rowCount, nil
+		}
+	}
+	return rowCount, rows.Err()
+}
+
+// hashRows runs query and returns how many rows it produced and a short hash of every column of
+// every row, as the server sent them, so a change in the data or its encoding changes the hash.
+// The query is cancelled once the rows exceed the budget.
+func hashRows(ctx context.Context, db rowQuerier, query string, budget *byteBudget) (int, string, error) {
+	queryCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(queryCtx, query)
+	if err != nil {
+		return 0, "", err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, "", err
+	}
+	values := make([]sql.Null[[]byte], len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	h := fnv.New32a()
+	rowCount := 0
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return rowCount, "", err
+		}
+		rowCount++
+		// Prefix each value with its length, or -1 for NULL, so adjacent values cannot run together
+		for _, value := range values {
+			length := int64(len(value.V))
+			if !value.Valid {
+				length = -1
+			}
+			binary.Write(h, binary.BigEndian, length)
+			h.Write(value.V)
+			if err := budget.add(len(value.V)); err != nil {
+				cancel()
+				return rowCount, "", err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return rowCount, "", err
+	}
+	return rowCount, fmt.Sprintf("%08x", h.Sum32()), nil
+}
+
+// RowBounds are the inclusive bounds on the number of rows the test query returns
+type RowBounds struct {
+	// Fewest rows, 0 for no minimum
+	Min int
+	// Most rows, -1 for no maximum
+	Max int
+}
+
+// contains reports whether rowCount is within the bounds
+func (b RowBounds) contains(rowCount int) bool {
+	return rowCount >= b.Min && (b.Max < 0 || rowCount <= b.Max)
+}
+
+// limit returns how many rows to count before the outcome is known: one past the maximum,
+// or the minimum when there is no maximum
+func (b RowBounds) limit() int {
+	if b.Max >= 0 {
+		return b.Max + 1
+	}
+	return b.Min
+}
+
+func (b RowBounds) String() string {
+	switch {
+	case b.Min == b.Max:
+		return fmt.Sprintf("exactly %d", b.Min)
+	case b.Max < 0:
+		return fmt.Sprintf("at least %d", b.Min)
+	case b.Min == 0:
+		return fmt.Sprintf("at most %d", b.Max)
+	default:
+		return fmt.Sprintf("between %d and %d", b.Min, b.Max)
+	}
+}
+
+// holdConnection pins one pooled connection, unless db already is one, and pings it every interval
+// until hold elapses. It returns how long the connection stayed usable and the first ping error, if any.
+func holdConnection(db querier, hold, interval, pingTimeout time.Duration) (time.Duration, error) {
+	holdStart := time.Now()
+
+	// Pin a single connection so a dropped one is not silently replaced by the pool
+	conn := db
+	if pool, ok := db.(*sql.DB); ok {
+		pinned, err := pool.Conn(context.Background())
+		if err != nil {
+			return 0, err
+		}
+		defer pinned.Close()
+		conn = pinned
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	deadline := time.NewTimer(hold)
+	defer deadline.Stop()
+
+	for {
+		select {
+		case <-deadline.C:
+			return time.Since(holdStart), nil
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+			err := conn.PingContext(ctx)
+			cancel()
+			if err != nil {
+				return time.Since(holdStart), err
+			}
+		}
+	}
+}
+
+// runScript executes statements in order on a single connection, so a BEGIN and COMMIT apply to
+// the statements between them. The returned error names the 1-based index of the failed statement,
+// after which an open transaction is rolled back so a persistent connection stays usable. With
+// readOnly, every transaction of the script is made read-only through the PostgreSQL session
+// characteristics, which are reset afterward.
+func runScript(ctx context.Context, db querier, statements []string, readOnly bool) error {
+	conn := db
+	if pool, ok := db.(*sql.DB); ok {
+		pinned, err := pool.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer pinned.Close()
+		conn = pinned
+	}
+
+	if readOnly {
+		if _, err := conn.ExecContext(ctx, "SET SESSION CHARACTERISTICS AS TRANSACTION READ ONLY"); err != nil {
+			return fmt.Errorf("failed to make the session read-only: %w", err)
+		}
+		defer conn.ExecContext(context.WithoutCancel(ctx), "RESET default_transaction_read_only")
+	}
+
+	for i, statement := range statements {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			conn.ExecContext(ctx, "ROLLBACK")
+			return fmt.Errorf("statement %d of %d: %w", i+1, len(statements), err)
+		}
+	}
+	return nil
+}
+
+// inRolledBackTx runs fn on db, or with readOnly or rollback on a transaction that is rolled
+// back afterward. With readOnly the transaction is read-only, so the queries fn runs cannot
+// write; with rollback, what they write is discarded, and a failed rollback is an error.
+func inRolledBackTx(ctx context.Context, db querier, readOnly, rollback bool, fn func(rowQuerier) error) error {
+	if !readOnly && !rollback {
+		return fn(db)
+	}
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: readOnly})
+	if err != nil {
+		return fmt.Errorf("failed to begin a transaction: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Rollback(); err != nil && rollback {
+		return fmt.Errorf("failed to roll back the transaction: %w", err)
+	}
+	return nil
+}
+
+// txPhases are how long each phase of a transaction probe took, zero for phases that did not run
+type txPhases struct {
+	begin, query, commit time.Duration
+}
+
+// runTransaction opens a transaction with BeginTx, read-only with readOnly, runs query in it as
+// queryFirstColumn does, and commits it, timing each phase. On failure it also returns the phase
+// that failed, begin, query, or commit, after rolling back the transaction if it is still open.
+func runTransaction(ctx context.Context, db querier, query string, readOnly bool) (any, txPhases, string, error) {
+	var phases txPhases
+	start := time.Now()
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: readOnly})
+	phases.begin = time.Since(start)
+	if err != nil {
+		return nil, phases, "begin", err
+	}
+
+	start = time.Now()
+	value, _, err := queryFirstColumn(ctx, tx, query)
+	phases.query = time.Since(start)
+	if err != nil {
+		tx.Rollback()
+		return nil, phases, "query", err
+	}
+
+	start = time.Now()
+	err = tx.Commit()
+	phases.commit = time.Since(start)
+	if err != nil {
+		return nil, phases, "commit", err
+	}
+	return value, phases, "", nil
+}
+
+// fetchPayload selects a payloadSize-byte string from the server so transfer time can be measured
+func fetchPayload(ctx context.Context, db querier, payloadSize int) (int, error) {
+	var payload []byte
+	query := fmt.Sprintf("SELECT repeat('x', %d)", payloadSize)
+	if err := db.QueryRowContext(ctx, query).Scan(&payload); err != nil {
+		return 0, err
+	}
+	return len(payload), nil
+}
@@ -0,0 +1,110 @@
+package conntester
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSplitExpect(t *testing.T) {
+	tests := []struct {
+		expected    string
+		wantOp      string
+		wantOperand string
+	}{
+		{expected: "1", wantOp: "", wantOperand: "1"},
+		{expected: ">=5", wantOp: ">=", wantOperand: "5"},
+		{expected: ">5", wantOp: ">", wantOperand: "5"},
+		{expected: "<=5", wantOp: "<=", wantOperand: "5"},
+		{expected: "<5", wantOp: "<", wantOperand: "5"},
+		{expected: "!=ok", wantOp: "!=", wantOperand: "ok"},
+		{expected: ">= 5 ", wantOp: ">=", wantOperand: "5"},
+		// A regular expression keeps its spaces
+		{expected: "~ ok ", wantOp: "~", wantOperand: " ok "},
+		// = alone is not an operator, so the value must equal "=5"
+		{expected: "=5", wantOp: "", wantOperand: "=5"},
+	}
+	for _, tt := range tests {
+		op, operand := splitExpect(tt.expected)
+		if op != tt.wantOp || operand != tt.wantOperand {
+			t.Errorf("splitExpect(%q) = %q, %q, want %q, %q", tt.expected, op, operand, tt.wantOp, tt.wantOperand)
+		}
+	}
+}
+
+func TestMatchesExpected(t *testing.T) {
+	tests := []struct {
+		value    any
+		expected string
+		want     bool
+	}{
+		// Equality
+		{value: int64(1), expected: "1", want: true},
+		{value: int64(1), expected: "2", want: false},
+		{value: []byte("ok"), expected: "ok", want: true},
+		{value: true, expected: "t", want: true},
+		{value: false, expected: "true", want: false},
+		{value: nil, expected: "NULL", want: true},
+		{value: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), expected: "2024-01-02T03:04:05Z", want: true},
+		{value: int64(1), expected: "!=2", want: true},
+		{value: int64(1), expected: "!=1", want: false},
+		{value: nil, expected: "!=1", want: true},
+
+		// >= is matched before >, so equal values satisfy >= but not >
+		{value: int64(5), expected: ">=5", want: true},
+		{value: int64(5), expected: ">5", want: false},
+		{value: int64(5), expected: "<=5", want: true},
+		{value: int64(5), expected: "<5", want: false},
+		{value: int64(6), expected: "> 5", want: true},
+
+		// Numbers compare numerically, not as strings
+		{value: int64(10), expected: ">9", want: true},
+		{value: float64(0.5), expected: "<1", want: true},
+		{value: []byte("10"), expected: ">9", want: true},
+
+		// Non-numeric operands compare as strings
+		{value: []byte("b"), expected: ">a", want: true},
+		{value: []byte("a"), expected: ">b", want: false},
+		{value: int64(10), expected: ">abc", want: false},
+		{value: []byte("abc"), expected: "<=abc", want: true},
+		{value: nil, expected: ">0", want: false},
+		{value: nil, expected: "<0", want: false},
+
+		// Regular expressions
+		{value: []byte("ok: 3 rows"), expected: "~^ok", want: true},
+		{value: []byte("error"), expected: "~^ok", want: false},
+		{value: int64(42), expected: `~^\d+$`, want: true},
+		{value: nil, expected: "~NULL", want: true},
+		// An invalid regular expression never matches
+		{value: []byte("["), expected: "~[", want: false},
+		{value: []byte("ok"), expected: "~(ok", want: false},
+	}
+	for _, tt := range tests {
+		if got := matchesExpected(tt.value, tt.expected); got != tt.want {
+			t.Errorf("matchesExpected(%#v, %q) = %v, want %v", tt.value, tt.expected, got, tt.want)
+		}
+	}
+}
+
+func TestCheckExpect(t *testing.T) {
+	tests := []struct {
+		expected string
+		wantErr  bool
+	}{
+		{expected: "", wantErr: false},
+		{expected: "1", wantErr: false},
+		{expected: ">=5", wantErr: false},
+		{expected: ">abc", wantErr: false},
+		{expected: "~^ok", wantErr: false},
+		{expected: "~[", wantErr: true},
+		{expected: "~(ok", wantErr: true},
+		// Only ~ operands are regular expressions
+		{expected: "[", wantErr: false},
+		{expected: "!=(", wantErr: false},
+	}
+	for _, tt := range tests {
+		err := CheckExpect(tt.expected)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CheckExpect(%q) = %v, want error %v", tt.expected, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package conntester
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// OutageTracker remembers when the current failure streak began so a recovery can report its length
+type OutageTracker struct {
+	firstFailure time.Time
+}
+
+// observe records an attempt result and returns the outage duration when the attempt ends a failure streak
+func (o *OutageTracker) observe(success bool, now time.Time) (time.Duration, bool) {
+	if !success {
+		if o.firstFailure.IsZero() {
+			o.firstFailure = now
+		}
+		return 0, false
+	}
+
+	if o.firstFailure.IsZero() {
+		return 0, false
+	}
+	outage := now.Sub(o.firstFailure)
+	o.firstFailure = time.Time{}
+	return outage, true
+}
+
+// reportRecovery logs the recovery and emits it as both an event, where the backend supports
+// events, and an outage duration metric
+func reportRecovery(client Backend, outage time.Duration, customTags []string, targetName string) {
+	outageMillis := outage.Milliseconds()
+	log.Printf("Connection recovered after outage (outage_duration_ms=%d)", outageMillis)
+
+	title := "conntester: connection recovered"
+	if targetName != "" {
+		title = fmt.Sprintf("conntester: %s recovered", targetName)
+	}
+	text := fmt.Sprintf("Connection recovered after an outage of %dms (outage_duration_ms=%d)", outageMillis, outageMillis)
+	if err := client.RecoveryEvent(title, text, customTags); err != nil {
+		log.Printf("Failed to emit recovery event: %v", err)
+	}
+
+	if err := client.RecordLatency(OutageDurationMetric, outage, customTags); err != nil {
+		log.Printf("Failed to emit outage duration metric: %v", err)
+	}
+}
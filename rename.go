@@ -0,0 +1,46 @@
+package conntester
+
+import (
+	"strings"
+	"time"
+)
+
+// RenamedBackend emits to another Backend with every metric name rewritten, for naming
+// conventions other than chalk.conntester.*. Events are passed through unchanged.
+type RenamedBackend struct {
+	Backend
+	namespace string
+	stem      string
+}
+
+// NewRenamedBackend returns a Backend that emits to backend with MetricStem replaced by stem
+// and namespace prepended to every metric name. An empty stem keeps MetricStem.
+func NewRenamedBackend(backend Backend, namespace, stem string) *RenamedBackend {
+	return &RenamedBackend{Backend: backend, namespace: namespace, stem: stem}
+}
+
+// MetricName returns the name a metric is emitted under
+func (b *RenamedBackend) MetricName(name string) string {
+	return b.namespace + RenameMetric(name, b.stem)
+}
+
+func (b *RenamedBackend) RecordLatency(name string, latency time.Duration, tags []string) error {
+	return b.Backend.RecordLatency(b.MetricName(name), latency, tags)
+}
+
+func (b *RenamedBackend) Count(name string, value int64, tags []string) error {
+	return b.Backend.Count(b.MetricName(name), value, tags)
+}
+
+func (b *RenamedBackend) Gauge(name string, value float64, tags []string) error {
+	return b.Backend.Gauge(b.MetricName(name), value, tags)
+}
+
+// RenameMetric replaces the MetricStem at the start of name with stem. Names not starting with
+// MetricStem, and an empty stem, leave name unchanged.
+func RenameMetric(name, stem string) string {
+	if rest, ok := strings.CutPrefix(name, MetricStem); ok && stem != "" {
+		return stem + rest
+	}
+	return name
+}
@@ -0,0 +1,57 @@
+package conntester
+
+import (
+	"time"
+)
+
+// TagFilterBackend emits to another Backend with some tag keys dropped from some metrics, so a
+// high-cardinality tag such as pg_version can stay on the latency metrics without multiplying
+// the contexts of the attempt counter. Events are passed through unchanged.
+type TagFilterBackend struct {
+	Backend
+	// Tag keys dropped, by metric name
+	drop map[string]map[string]bool
+}
+
+// NewTagFilterBackend returns a Backend that emits to backend without the tags whose keys drop
+// lists for the metric, keyed by metric name such as AttemptCountMetric
+func NewTagFilterBackend(backend Backend, drop map[string][]string) *TagFilterBackend {
+	b := &TagFilterBackend{Backend: backend, drop: make(map[string]map[string]bool, len(drop))}
+	for name, keys := range drop {
+		if b.drop[name] == nil {
+			b.drop[name] = make(map[string]bool, len(keys))
+		}
+		for _, key := range keys {
+			b.drop[name][key] = true
+		}
+	}
+	return b
+}
+
+// filter returns the tags the metric is emitted with
+func (b *TagFilterBackend) filter(name string, tags []string) []string {
+	dropped := b.drop[name]
+	if len(dropped) == 0 {
+		return tags
+	}
+
+	result := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if !dropped[tagKey(tag)] {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+func (b *TagFilterBackend) RecordLatency(name string, latency time.Duration, tags []string) error {
+	return b.Backend.RecordLatency(name, latency, b.filter(name, tags))
+}
+
+func (b *TagFilterBackend) Count(name string, value int64, tags []string) error {
+	return b.Backend.Count(name, value, b.filter(name, tags))
+}
+
+func (b *TagFilterBackend) Gauge(name string, value float64, tags []string) error {
+	return b.Backend.Gauge(name, value, b.filter(name, tags))
+}
@@ -0,0 +1,91 @@
+package conntester
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Longest tag Datadog accepts; longer tags are truncated
+const maxTagLength = 200
+
+// ParseTags parses a string in the format "k1:v1,k2:v2" into a slice of "k1:v1", "k2:v2"
+func ParseTags(tagsStr string) []string {
+	if tagsStr == "" {
+		return nil
+	}
+
+	var result []string
+	tagPairs := strings.Split(tagsStr, ",")
+
+	for _, pair := range tagPairs {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		// Only add pairs that have the format k:v
+		if strings.Contains(pair, ":") {
+			result = append(result, pair)
+		}
+	}
+
+	return result
+}
+
+// TagProblems returns a description of each pair in a "k1:v1,k2:v2" string that ParseTags drops,
+// or that Datadog would rewrite: pairs without a colon, keys not starting with a letter,
+// characters other than letters, digits, and _-:./, and tags over 200 characters.
+// Well-formed input returns nil.
+func TagProblems(tagsStr string) []string {
+	var problems []string
+	for _, pair := range strings.Split(tagsStr, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, _, ok := strings.Cut(pair, ":")
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%q has no colon and is ignored", pair))
+		case key == "" || !isLetter(rune(key[0])):
+			problems = append(problems, fmt.Sprintf("%q must start with a letter", pair))
+		case strings.IndexFunc(pair, func(r rune) bool { return !isTagChar(r) }) >= 0:
+			problems = append(problems, fmt.Sprintf("%q contains characters other than letters, digits, and _-:./", pair))
+		case len(pair) > maxTagLength:
+			problems = append(problems, fmt.Sprintf("%q is longer than %d characters", pair, maxTagLength))
+		}
+	}
+	return problems
+}
+
+func isLetter(r rune) bool {
+	return ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z')
+}
+
+// isTagChar reports whether Datadog keeps r in a tag rather than replacing it with an underscore
+func isTagChar(r rune) bool {
+	return isLetter(r) || ('0' <= r && r <= '9') || strings.ContainsRune("_-:./", r)
+}
+
+// MergeTags combines two tag lists, letting override tags replace base tags with the same key
+func MergeTags(base, override []string) []string {
+	overridden := make(map[string]bool, len(override))
+	for _, tag := range override {
+		overridden[tagKey(tag)] = true
+	}
+
+	var result []string
+	for _, tag := range base {
+		if !overridden[tagKey(tag)] {
+			result = append(result, tag)
+		}
+	}
+	return append(result, override...)
+}
+
+// tagKey returns the key portion of a k:v tag
+func tagKey(tag string) string {
+	key, _, _ := strings.Cut(tag, ":")
+	return key
+}
@@ -0,0 +1,91 @@
+package conntester
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// TLS record content types, the first byte of every TLS record
+const (
+	tlsRecordHandshake       = 0x16
+	tlsRecordApplicationData = 0x17
+)
+
+// dialTrace records how long the TCP connect and TLS handshake of a connection took.
+// Only the first connection dialed with it is recorded.
+type dialTrace struct {
+	mu        sync.Mutex
+	dialed    bool
+	tcp       time.Duration
+	tcpErr    error
+	handshake bool
+	tls       time.Duration
+}
+
+// recordTCP records the outcome of the TCP connect
+func (t *dialTrace) recordTCP(latency time.Duration, err error) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dialed {
+		return false
+	}
+	t.dialed, t.tcp, t.tcpErr = true, latency, err
+	return true
+}
+
+// recordTLS records a completed TLS handshake
+func (t *dialTrace) recordTLS(latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handshake, t.tls = true, latency
+}
+
+// durations returns the TCP connect time, if a connection was dialed, and the TLS
+// handshake time, if one completed
+func (t *dialTrace) durations() (tcp time.Duration, dialed bool, tls time.Duration, handshake bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tcp, t.dialed, t.tls, t.handshake
+}
+
+// tracedConn times the TLS handshake the driver runs over the connection. lib/pq gives no
+// hook around the handshake, so it is inferred from the TLS records the client writes: it
+// starts with the ClientHello and has completed once the client sends application data,
+// which in TLS 1.3 includes the encrypted client Finished message.
+type tracedConn struct {
+	net.Conn
+	trace *dialTrace
+
+	handshakeStart time.Time
+	handshakeDone  bool
+}
+
+func (c *tracedConn) Write(b []byte) (int, error) {
+	if !c.handshakeDone {
+		if c.handshakeStart.IsZero() {
+			if len(b) > 0 && b[0] == tlsRecordHandshake {
+				c.handshakeStart = time.Now()
+			}
+		} else if hasTLSRecord(b, tlsRecordApplicationData) {
+			c.trace.recordTLS(time.Since(c.handshakeStart))
+			c.handshakeDone = true
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+// hasTLSRecord reports whether any of the TLS records in b has the given content type
+func hasTLSRecord(b []byte, contentType byte) bool {
+	for len(b) >= 5 {
+		if b[0] == contentType {
+			return true
+		}
+		length := int(b[3])<<8 | int(b[4])
+		if len(b) < 5+length {
+			return false
+		}
+		b = b[5+length:]
+	}
+	return false
+}
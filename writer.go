@@ -0,0 +1,71 @@
+package conntester
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WriterBackend writes every metric to an io.Writer as a line in the DogStatsD datagram format,
+// e.g. "chalk.conntester.attempt_count:1|c|#status:success", instead of sending it anywhere.
+// Useful for a dry run that shows exactly which metrics and tags would be emitted.
+type WriterBackend struct {
+	// Write latencies as histograms (|h) instead of distributions (|d)
+	Histograms bool
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterBackend returns a Backend that writes to w
+func NewWriterBackend(w io.Writer) *WriterBackend {
+	return &WriterBackend{w: w}
+}
+
+func (b *WriterBackend) RecordLatency(name string, latency time.Duration, tags []string) error {
+	metricType := "d"
+	if b.Histograms {
+		metricType = "h"
+	}
+	return b.write("%s:%s|%s%s\n", name, strconv.FormatFloat(latency.Seconds(), 'f', -1, 64), metricType, tagSuffix(tags))
+}
+
+func (b *WriterBackend) Count(name string, value int64, tags []string) error {
+	return b.write("%s:%d|c%s\n", name, value, tagSuffix(tags))
+}
+
+func (b *WriterBackend) Gauge(name string, value float64, tags []string) error {
+	return b.write("%s:%s|g%s\n", name, strconv.FormatFloat(value, 'f', -1, 64), tagSuffix(tags))
+}
+
+// RecoveryEvent writes the event in the DogStatsD event format with the success alert type
+func (b *WriterBackend) RecoveryEvent(title, text string, tags []string) error {
+	return b.write("_e{%d,%d}:%s|%s|t:success%s\n", len(title), len(text), title, text, tagSuffix(tags))
+}
+
+func (b *WriterBackend) Flush() error {
+	return nil
+}
+
+func (b *WriterBackend) Close() error {
+	return nil
+}
+
+// write formats one line, serializing writes from concurrent attempts
+func (b *WriterBackend) write(format string, args ...any) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := fmt.Fprintf(b.w, format, args...)
+	return err
+}
+
+// tagSuffix formats tags as the |#k:v,... suffix of a datagram, empty without tags
+func tagSuffix(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	return "|#" + strings.Join(tags, ",")
+}